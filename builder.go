@@ -0,0 +1,278 @@
+package http_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	urlLib "net/url"
+	"strings"
+	"time"
+
+	http "github.com/vimbing/fhttp"
+	"golang.org/x/net/http/httpguts"
+)
+
+// ErrInvalidRequest is returned by RequestBuilder for requests that can't
+// be sent.
+var ErrInvalidRequest = errors.New("invalid request")
+
+// RequestBuilder builds a request step by step, every per-request override
+// of the client has a step. Steps can be chained in any order, later ones
+// win over earlier ones setting the same thing.
+type RequestBuilder struct {
+	client *Client
+
+	method  string
+	url     string
+	header  http.Header
+	query   OrderedQueryParams
+	form    OrderedFormUrlEncoded
+	body    RequestOption
+	options []RequestOption
+
+	timeout    time.Duration
+	timeouts   *Timeouts
+	proxy      *string
+	host       *string
+	tlsProfile *TlsProfile
+	protocol   Protocol
+}
+
+// R starts a GET request built by chaining steps, Do sends it.
+func (c *Client) R() *RequestBuilder {
+	return &RequestBuilder{
+		client: c,
+		method: "GET",
+		header: http.Header{},
+	}
+}
+
+func (b *RequestBuilder) Method(method string) *RequestBuilder {
+	b.method = method
+	return b
+}
+
+func (b *RequestBuilder) URL(url string) *RequestBuilder {
+	b.url = url
+	return b
+}
+
+// Header adds value to the values of key.
+func (b *RequestBuilder) Header(key, value string) *RequestBuilder {
+	b.header.Add(key, value)
+	return b
+}
+
+// Headers adds all values of header, including the order keys.
+func (b *RequestBuilder) Headers(header http.Header) *RequestBuilder {
+	for key, values := range header {
+		b.header[key] = append(b.header[key], values...)
+	}
+
+	return b
+}
+
+// Query appends a query parameter, keys may repeat.
+func (b *RequestBuilder) Query(key, value string) *RequestBuilder {
+	b.query = append(b.query, Param{Key: key, Value: value})
+	return b
+}
+
+// Form appends a field of a url-encoded body, keys may repeat.
+func (b *RequestBuilder) Form(key, value string) *RequestBuilder {
+	b.form = append(b.form, Param{Key: key, Value: value})
+	b.body = nil
+	return b
+}
+
+func (b *RequestBuilder) JSON(value any) *RequestBuilder {
+	return b.setBody(WithJSON(value))
+}
+
+func (b *RequestBuilder) Body(body io.Reader) *RequestBuilder {
+	return b.setBody(WithBody(body))
+}
+
+func (b *RequestBuilder) Multipart(form MultipartForm) *RequestBuilder {
+	return b.setBody(form)
+}
+
+func (b *RequestBuilder) setBody(body RequestOption) *RequestBuilder {
+	b.body = body
+	b.form = nil
+	return b
+}
+
+// Option applies options after the other steps.
+func (b *RequestBuilder) Option(options ...RequestOption) *RequestBuilder {
+	b.options = append(b.options, options...)
+	return b
+}
+
+// Timeout overrides the total timeout of the client, see
+// Request.SetTimeout.
+func (b *RequestBuilder) Timeout(timeout time.Duration) *RequestBuilder {
+	b.timeout = timeout
+	return b
+}
+
+// Timeouts overrides the phase timeouts of the client, see
+// Request.SetTimeouts.
+func (b *RequestBuilder) Timeouts(timeouts Timeouts) *RequestBuilder {
+	b.timeouts = &timeouts
+	return b
+}
+
+// Proxy sends the request through proxy, see Request.SetProxy.
+func (b *RequestBuilder) Proxy(proxy string) *RequestBuilder {
+	b.proxy = &proxy
+	return b
+}
+
+// Host overrides the Host header, see Request.SetHost.
+func (b *RequestBuilder) Host(host string) *RequestBuilder {
+	b.host = &host
+	return b
+}
+
+// TlsProfile overrides the profile of the client, see
+// Request.SetTlsProfile.
+func (b *RequestBuilder) TlsProfile(profile TlsProfile) *RequestBuilder {
+	b.tlsProfile = &profile
+	return b
+}
+
+// Protocol overrides the protocol preference of the client, see
+// Request.SetProtocol.
+func (b *RequestBuilder) Protocol(protocol Protocol) *RequestBuilder {
+	b.protocol = protocol
+	return b
+}
+
+// Build validates the steps and returns the request they describe.
+func (b *RequestBuilder) Build() (*Request, error) {
+	if err := b.validate(); err != nil {
+		return nil, err
+	}
+
+	options := []RequestOption{WithHeader(b.header.Clone())}
+
+	if len(b.query) > 0 {
+		options = append(options, b.query)
+	}
+
+	if len(b.form) > 0 {
+		options = append(options, b.form)
+	}
+
+	if b.body != nil {
+		options = append(options, b.body)
+	}
+
+	req, err := b.client.Request(b.method, b.url, append(options, b.options...)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if b.timeouts != nil {
+		req.SetTimeouts(*b.timeouts)
+	}
+
+	if b.timeout != 0 {
+		req.SetTimeout(b.timeout)
+	}
+
+	if b.proxy != nil {
+		req.SetProxy(*b.proxy)
+	}
+
+	if b.host != nil {
+		req.SetHost(*b.host)
+	}
+
+	if b.tlsProfile != nil {
+		req.SetTlsProfile(*b.tlsProfile)
+	}
+
+	req.SetProtocol(b.protocol)
+
+	return req, nil
+}
+
+// Do builds the request and sends it, retried as configured. Cancelling ctx
+// aborts it and stops the retries, Do then returns the error of ctx.
+func (b *RequestBuilder) Do(ctx context.Context) (*Response, error) {
+	req, err := b.Build()
+
+	if err != nil {
+		return &Response{}, err
+	}
+
+	return b.client.snapshot().cfg.retry.retryContext(ctx, func(req *Request) (*Response, error) {
+		return b.client.doContext(ctx, req)
+	}, req)
+}
+
+func (b *RequestBuilder) validate() error {
+	if !httpguts.ValidHeaderFieldName(b.method) {
+		return fmt.Errorf("%w: method %q", ErrInvalidRequest, b.method)
+	}
+
+	if err := validateURL(b.url); err != nil {
+		return err
+	}
+
+	for key, values := range b.header {
+		if key == http.HeaderOrderKey || key == http.PHeaderOrderKey {
+			continue
+		}
+
+		if !httpguts.ValidHeaderFieldName(key) {
+			return fmt.Errorf("%w: header name %q", ErrInvalidRequest, key)
+		}
+
+		for _, value := range values {
+			if !httpguts.ValidHeaderFieldValue(value) {
+				return fmt.Errorf("%w: value of header %s", ErrInvalidRequest, key)
+			}
+		}
+	}
+
+	if b.timeout < 0 {
+		return fmt.Errorf("%w: negative timeout", ErrInvalidRequest)
+	}
+
+	if b.proxy != nil {
+		proxyURL, err := urlLib.Parse(*b.proxy)
+
+		if err != nil || proxyURL.Host == "" {
+			return fmt.Errorf("%w: %q", ErrProxyFormatCorrupted, *b.proxy)
+		}
+	}
+
+	return nil
+}
+
+func validateURL(url string) error {
+	if _, ok := unixSocketURL(url); ok {
+		return nil
+	}
+
+	parsed, err := urlLib.Parse(url)
+
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidRequest, err)
+	}
+
+	if scheme := strings.ToLower(parsed.Scheme); scheme != "http" && scheme != "https" {
+		return fmt.Errorf("%w: url %q is not http or https", ErrInvalidRequest, url)
+	}
+
+	if parsed.Host == "" {
+		return fmt.Errorf("%w: url %q has no host", ErrInvalidRequest, url)
+	}
+
+	return nil
+}
@@ -0,0 +1,238 @@
+package http_client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type receivedRequest struct {
+	Method string
+	Query  string
+	Host   string
+	Header string
+	Type   string
+	Body   string
+}
+
+func TestRequestBuilder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		json.NewEncoder(w).Encode(receivedRequest{
+			Method: r.Method,
+			Query:  r.URL.RawQuery,
+			Host:   r.Host,
+			Header: r.Header.Get("x-test"),
+			Type:   r.Header.Get("content-type"),
+			Body:   string(body),
+		})
+	}))
+
+	defer server.Close()
+
+	client := MustNewClient()
+
+	testCases := []struct {
+		name     string
+		builder  *RequestBuilder
+		expected receivedRequest
+	}{
+		{
+			name: "json",
+			builder: client.R().
+				Method("POST").
+				URL(server.URL+"/path?a=1").
+				Header("x-test", "1").
+				Query("b", "2").
+				Query("b", "3").
+				JSON(map[string]int{"count": 1}),
+			expected: receivedRequest{Method: "POST", Query: "a=1&b=2&b=3", Host: server.Listener.Addr().String(), Header: "1", Body: `{"count":1}`},
+		},
+		{
+			name: "form",
+			builder: client.R().
+				Method("PATCH").
+				URL(server.URL).
+				Host("example.com").
+				Form("user", "jane").
+				Form("tag", "a b"),
+			expected: receivedRequest{Method: "PATCH", Host: "example.com", Type: "application/x-www-form-urlencoded", Body: "user=jane&tag=a+b"},
+		},
+		{
+			name:     "get",
+			builder:  client.R().URL(server.URL),
+			expected: receivedRequest{Method: "GET", Host: server.Listener.Addr().String()},
+		},
+	}
+
+	for _, testCase := range testCases {
+		res, err := testCase.builder.Do(context.Background())
+
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", testCase.name, err)
+		}
+
+		var received receivedRequest
+
+		if err := json.Unmarshal(res.Body, &received); err != nil {
+			t.Fatalf("Unexpected response for %s %s: %v", testCase.name, res.BodyString(), err)
+		}
+
+		if received != testCase.expected {
+			t.Errorf("Unexpected request for %s, expected: %+v got: %+v", testCase.name, testCase.expected, received)
+		}
+	}
+}
+
+func TestRequestBuilderValidation(t *testing.T) {
+	client := MustNewClient()
+
+	testCases := []struct {
+		name     string
+		builder  *RequestBuilder
+		expected error
+	}{
+		{name: "no url", builder: client.R(), expected: ErrInvalidRequest},
+		{name: "scheme", builder: client.R().URL("ftp://127.0.0.1/"), expected: ErrInvalidRequest},
+		{name: "method", builder: client.R().URL("http://127.0.0.1/").Method("GET /"), expected: ErrInvalidRequest},
+		{name: "header", builder: client.R().URL("http://127.0.0.1/").Header("x-test", "a\nb"), expected: ErrInvalidRequest},
+		{name: "proxy", builder: client.R().URL("http://127.0.0.1/").Proxy("127.0.0.1"), expected: ErrProxyFormatCorrupted},
+		{name: "boundary", builder: client.R().URL("http://127.0.0.1/").Multipart(MultipartForm{Boundary: "\""}), expected: ErrMultipartBoundary},
+	}
+
+	for _, testCase := range testCases {
+		if _, err := testCase.builder.Build(); !errors.Is(err, testCase.expected) {
+			t.Errorf("Unexpected error for %s: %v", testCase.name, err)
+		}
+	}
+
+	req, err := client.R().URL("unix:///tmp/test.sock:/ping").Timeout(time.Second).Protocol(ProtocolHTTP1).Build()
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if req.timeouts.Total != time.Second || req.protocol != ProtocolHTTP1 {
+		t.Errorf("Unexpected overrides: %+v %s", req.timeouts, req.protocol)
+	}
+}
+
+func TestRequestBuilderTimeout(t *testing.T) {
+	_, err := MustNewClient().R().
+		URL(fmt.Sprintf("http://127.0.0.1:%d/timeout?timeoutMs=1000", testServerPort)).
+		Timeout(50 * time.Millisecond).
+		Do(context.Background())
+
+	if !errors.Is(err, ErrRequestTimedOut) {
+		t.Errorf("Expected ErrRequestTimedOut, got: %v", err)
+	}
+}
+
+func TestRequestBuilderRetryStopsOnCancel(t *testing.T) {
+	var attempts atomic.Int64
+
+	client := MustNewClient(OptionRetryPolicy{&Retry{Max: 5, OnError: func(error) { attempts.Add(1) }}})
+	url := fmt.Sprintf("http://127.0.0.1:%d/timeout?timeoutMs=1000", testServerPort)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	if _, err := client.R().URL(url).Do(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := client.SendContext(ctx, "GET", url); !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrRetryExceed) {
+		t.Errorf("Expected context.DeadlineExceeded, got: %v", err)
+	}
+
+	if attempts.Load() != 2 {
+		t.Errorf("Unexpected attempts: %d", attempts.Load())
+	}
+}
+
+func TestRequestProxy(t *testing.T) {
+	proxyAddr := startConnectProxy(t)
+	proxy := fmt.Sprintf("http://%s", proxyAddr)
+	client := MustNewClient()
+
+	for i := 0; i < 2; i++ {
+		res, err := client.R().
+			URL(fmt.Sprintf("http://127.0.0.1:%d/ping", testServerPort)).
+			Proxy(proxy).
+			Do(context.Background())
+
+		if err != nil {
+			t.Fatalf("Unexpected error while getting test server through proxy: %v", err)
+		}
+
+		if info := res.ConnInfo(); info.Proxy != proxy || info.RemoteAddr.String() != proxyAddr {
+			t.Errorf("Unexpected connection, expected the proxy %s got: %+v", proxy, info)
+		}
+	}
+
+	if client.proxyStates.len() != 1 {
+		t.Errorf("Unexpected proxy transports: %d", client.proxyStates.len())
+	}
+
+	res, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/ping", testServerPort))
+
+	if err != nil {
+		t.Fatalf("Unexpected error while getting test server: %v", err)
+	}
+
+	if info := res.ConnInfo(); info.Proxy != "" {
+		t.Errorf("Unexpected proxy for the client: %s", info.Proxy)
+	}
+
+	client.DisableProxy()
+
+	if client.proxyStates != nil {
+		t.Errorf("Proxy transports survived a reconfiguration")
+	}
+}
+
+func TestRequestProxyStatesBound(t *testing.T) {
+	proxyAddr := startConnectProxy(t)
+	url := fmt.Sprintf("http://127.0.0.1:%d/ping", testServerPort)
+	client := MustNewClient()
+
+	// every user makes another proxy URL for the same proxy
+	proxy := func(i int) string {
+		return fmt.Sprintf("http://user%d@%s", i, proxyAddr)
+	}
+
+	var first *profileRoundTripper
+
+	for i := 0; i <= maxProxyStates; i++ {
+		if _, err := client.R().URL(url).Proxy(proxy(i)).Do(context.Background()); err != nil {
+			t.Fatalf("Unexpected error while getting test server through proxy %d: %v", i, err)
+		}
+
+		if i == 0 {
+			state, _ := client.proxyStates.get(proxy(0))
+			first = state.fhttpClient.Transport.(*profileRoundTripper)
+		}
+	}
+
+	if client.proxyStates.len() != maxProxyStates {
+		t.Errorf("Unexpected proxy transports: %d", client.proxyStates.len())
+	}
+
+	if _, ok := client.proxyStates.get(proxy(0)); ok {
+		t.Errorf("The least recently used proxy transport was kept")
+	}
+
+	// the evicted transport closes its idle connection
+	waitFor(t, func() bool { return first.poolStats()[0].Connections == 0 })
+}
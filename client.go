@@ -2,25 +2,88 @@ package http_client
 
 import (
 	"bytes"
+	"context"
 	"io"
 
 	"github.com/samber/lo"
 	"github.com/vimbing/fhttp/cookiejar"
 )
 
+// snapshot returns the configuration and fhttp client currently in use.
+// Both are treated as immutable, reconfiguration swaps in new copies, so a
+// request keeps the snapshot it started with.
+func (c *Client) snapshot() clientState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return clientState{
+		cfg:         c.cfg,
+		fhttpClient: c.fhttpClient,
+	}
+}
+
+// close closes the connections of the transport of s once they are idle.
+func (s clientState) close() {
+	if rt, ok := s.fhttpClient.Transport.(*profileRoundTripper); ok {
+		rt.close()
+	}
+}
+
+// reconfigure applies mutate to a copy of the current configuration and
+// swaps it in. When rebind is set the copy gets a freshly built transport.
+func (c *Client) reconfigure(mutate func(cfg *Config), rebind bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cfg := c.cfg.clone()
+	mutate(cfg)
+
+	fhttpClient := *c.fhttpClient
+
+	if cfg.jar != nil {
+		fhttpClient.Jar = cfg.jar
+	}
+
+	if rebind {
+		if err := rebindRoundtripper(&fhttpClient, cfg); err != nil {
+			return err
+		}
+	}
+
+	c.cfg = cfg
+	c.fhttpClient = &fhttpClient
+
+	if c.proxyStates != nil {
+		for _, state := range c.proxyStates.values() {
+			go state.close()
+		}
+
+		c.proxyStates = nil
+	}
+
+	return nil
+}
+
 func (c *Client) BindJar(jar *cookiejar.Jar) {
-	c.cfg.jar = jar
-	c.fhttpClient.Jar = jar
+	c.reconfigure(func(cfg *Config) {
+		cfg.jar = jar
+	}, false)
 }
 
-func (c *Client) executeRequest(req *Request, resultChan chan *requestExecutionResult) {
+func (c *Client) executeRequest(ctx context.Context, state clientState, req *Request, exec *requestExecution, resultChan chan *requestExecutionResult) {
 	defer close(resultChan)
 
-	fhttpRes, err := c.fhttpClient.Do(req.fhttpRequest)
+	exec.setPhase(PhaseResponseHeaders)
+
+	fhttpRes, err := state.fhttpClient.Do(req.fhttpRequest)
 
 	if err != nil {
-		if len(c.cfg.responseErrorMiddleware) > 0 {
-			for _, m := range c.cfg.responseErrorMiddleware {
+		err = exec.timeoutErr(ctx, err)
+
+		// The caller has already given up on this request, nobody is
+		// interested in its outcome anymore.
+		if ctx.Err() == nil && len(state.cfg.responseErrorMiddleware) > 0 {
+			for _, m := range state.cfg.responseErrorMiddleware {
 				m(req, err)
 			}
 		}
@@ -32,24 +95,44 @@ func (c *Client) executeRequest(req *Request, resultChan chan *requestExecutionR
 		return
 	}
 
+	// Closing the body before it is drained makes fhttp tear the connection
+	// down instead of returning it to the pool, which is what we want for
+	// requests that got abandoned halfway through.
 	defer fhttpRes.Body.Close()
 
-	decodedBody, err := decodeResponseBody(fhttpRes.Header, fhttpRes.Body)
+	exec.setPhase(PhaseBodyRead)
 
-	if err != nil {
-		resultChan <- &requestExecutionResult{
-			error: err,
-		}
-
-		return
-	}
+	stopBodyTimer := exec.startPhaseTimer(PhaseBodyRead, exec.timeouts.BodyRead)
+	defer stopBodyTimer()
 
 	buff := bytes.NewBuffer([]byte{})
 	defer buff.Reset()
 
-	if _, err := io.Copy(buff, decodedBody); err != nil {
+	// Content-Encoding describes the body these responses leave out, there
+	// is nothing to decode.
+	if hasResponseBody(req.fhttpRequest.Method, fhttpRes.StatusCode) {
+		decodedBody, err := decodeResponseBody(fhttpRes.Header, fhttpRes.Body)
+
+		if err != nil {
+			resultChan <- &requestExecutionResult{
+				error: exec.timeoutErr(ctx, err),
+			}
+
+			return
+		}
+
+		if _, err := io.Copy(buff, decodedBody); err != nil {
+			resultChan <- &requestExecutionResult{
+				error: exec.timeoutErr(ctx, err),
+			}
+
+			return
+		}
+	}
+
+	if ctx.Err() != nil {
 		resultChan <- &requestExecutionResult{
-			error: err,
+			error: exec.timeoutErr(ctx, ctx.Err()),
 		}
 
 		return
@@ -60,7 +143,27 @@ func (c *Client) executeRequest(req *Request, resultChan chan *requestExecutionR
 		fhttpResponse: fhttpRes,
 	}
 
-	for _, m := range c.cfg.responseMiddleware {
+	if connInfo := exec.connInfo.Load(); connInfo != nil {
+		res.connInfo = *connInfo
+	}
+
+	// without ALPN the protocol is only known from the response
+	if len(res.connInfo.NegotiatedProtocol) == 0 {
+		res.connInfo.NegotiatedProtocol = "http/1.1"
+
+		if fhttpRes.ProtoMajor == 2 {
+			res.connInfo.NegotiatedProtocol = "h2"
+		}
+	}
+
+	if transport, ok := state.fhttpClient.Transport.(*profileRoundTripper); ok {
+		res.connInfo.Proxy = transport.proxy
+	}
+
+	exec.setPhase(PhaseMiddleware)
+	res.timings = exec.clock.timings()
+
+	for _, m := range state.cfg.responseMiddleware {
 		if err := m(res); err != nil {
 			resultChan <- &requestExecutionResult{
 				res:   res,
@@ -78,18 +181,92 @@ func (c *Client) executeRequest(req *Request, resultChan chan *requestExecutionR
 }
 
 func (c *Client) RotateProxy() error {
-	return rebindRoundtripper(c.fhttpClient, c.cfg)
+	_, err := c.rotate()
+	return err
+}
+
+// rotate binds a new transport, picking a proxy again, and returns the
+// snapshot that includes it.
+func (c *Client) rotate() (clientState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fhttpClient := *c.fhttpClient
+
+	if err := rebindRoundtripper(&fhttpClient, c.cfg); err != nil {
+		return clientState{}, err
+	}
+
+	c.fhttpClient = &fhttpClient
+
+	return clientState{cfg: c.cfg, fhttpClient: c.fhttpClient}, nil
+}
+
+// maxProxyStates bounds the proxies a client keeps transports for, the
+// least recently used one is dropped and its idle connections closed
+// beyond it.
+const maxProxyStates = 32
+
+// proxyState returns state with a transport going through proxy. It is
+// shared by the requests using that proxy until the client is reconfigured.
+func (c *Client) proxyState(state clientState, proxy string) (clientState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current := state.cfg == c.cfg
+
+	if c.proxyStates != nil && current {
+		if cached, ok := c.proxyStates.get(proxy); ok {
+			return cached, nil
+		}
+	}
+
+	cfg := state.cfg.clone()
+	cfg.proxies = []string{proxy}
+
+	fhttpClient := *state.fhttpClient
+
+	if err := rebindRoundtripper(&fhttpClient, cfg); err != nil {
+		return clientState{}, err
+	}
+
+	proxyState := clientState{cfg: cfg, fhttpClient: &fhttpClient}
+
+	// a snapshot taken before a reconfiguration is not worth keeping
+	if current {
+		if c.proxyStates == nil {
+			c.proxyStates = newLRUCache[string, clientState](maxProxyStates)
+		}
+
+		if evicted, ok := c.proxyStates.add(proxy, proxyState); ok {
+			go evicted.close()
+		}
+	}
+
+	return proxyState, nil
 }
 
 func (c *Client) Do(req *Request) (*Response, error) {
-	for _, m := range c.cfg.requestMiddleware {
+	return c.doContext(context.Background(), req)
+}
+
+func (c *Client) doContext(parent context.Context, req *Request) (*Response, error) {
+	state := c.snapshot()
+
+	for _, m := range state.cfg.requestMiddleware {
 		if err := m(req); err != nil {
 			return &Response{}, err
 		}
 	}
 
-	ctx, reqCtxCancel, err := req.Build(
-		c.cfg.timeout,
+	exec := newRequestExecution(state.cfg.timeouts.merge(req.timeouts), state.cfg.hooks)
+	execCtx, execCancel := exec.bind(parent)
+
+	defer execCancel(nil)
+
+	ctx, reqCtxCancel, err := req.build(
+		execCtx,
+		exec.timeouts.Total,
 	)
 
 	defer reqCtxCancel()
@@ -100,68 +277,84 @@ func (c *Client) Do(req *Request) (*Response, error) {
 
 	resultChan := make(chan *requestExecutionResult, 1)
 
-	if c.cfg.forceRotation {
-		err := rebindRoundtripper(c.fhttpClient, c.cfg)
-
-		if err != nil {
-			return nil, err
-		}
+	switch {
+	case req.proxy != nil:
+		state, err = c.proxyState(state, *req.proxy)
+	case state.cfg.forceRotation:
+		state, err = c.rotate()
 	}
 
-	go c.executeRequest(req, resultChan)
+	if err != nil {
+		return nil, err
+	}
 
-	for {
-		select {
-		case result := <-resultChan:
-			if result.error != nil {
-				return result.res, result.error
-			}
+	go c.executeRequest(ctx, state, req, exec, resultChan)
 
-			if c.cfg.statusValidationFunc != nil {
-				return result.res, c.cfg.statusValidationFunc(result.res.StatusCode(), c)
-			}
+	select {
+	case result := <-resultChan:
+		if result.error != nil {
+			return result.res, result.error
+		}
 
-			return result.res, nil
-		case <-ctx.Done():
-			return nil, ErrRequestTimedOut
+		if state.cfg.statusValidationFunc != nil {
+			return result.res, state.cfg.statusValidationFunc(result.res.StatusCode(), c)
 		}
+
+		return result.res, nil
+	case <-ctx.Done():
+		// Cancelling the context aborts the in-flight round trip and closes
+		// its connection, executeRequest then unwinds on its own.
+		reqCtxCancel()
+		return nil, exec.timeoutErr(ctx, ctx.Err())
 	}
 }
 
 func (c *Client) UseRequest(f RequestMiddlewareFunc) {
-	c.cfg.requestMiddleware = append(c.cfg.requestMiddleware, f)
+	c.reconfigure(func(cfg *Config) {
+		cfg.requestMiddleware = append(cfg.requestMiddleware, f)
+	}, false)
 }
 
 func (c *Client) UseResponse(f ResponseMiddlewareFunc) {
-	c.cfg.responseMiddleware = append(c.cfg.responseMiddleware, f)
+	c.reconfigure(func(cfg *Config) {
+		cfg.responseMiddleware = append(cfg.responseMiddleware, f)
+	}, false)
 }
 
 func (c *Client) UseResponseError(f ResponseErrorMiddlewareFunc) {
-	c.cfg.responseErrorMiddleware = append(c.cfg.responseErrorMiddleware, f)
+	c.reconfigure(func(cfg *Config) {
+		cfg.responseErrorMiddleware = append(cfg.responseErrorMiddleware, f)
+	}, false)
 }
 
 func (c *Client) DisableProxy() {
-	c.cfg.proxies = []string{}
-	rebindRoundtripper(c.fhttpClient, c.cfg)
+	c.reconfigure(func(cfg *Config) {
+		cfg.proxies = []string{}
+	}, true)
 }
 
 func (c *Client) ChangeProxy(proxy string) {
 	p, _ := parseSingleProxy(proxy)
-	c.cfg.proxies = []string{string(p)}
-	rebindRoundtripper(c.fhttpClient, c.cfg)
+
+	c.reconfigure(func(cfg *Config) {
+		cfg.proxies = []string{string(p)}
+	}, true)
 }
 
 func (c *Client) ChangeProxyList(proxies []string) {
-	c.cfg.proxies = lo.Map(parseList(proxies), func(p OptionProxy, i int) string { return string(p) })
-	rebindRoundtripper(c.fhttpClient, c.cfg)
+	c.reconfigure(func(cfg *Config) {
+		cfg.proxies = lo.Map(parseList(proxies), func(p OptionProxy, i int) string { return string(p) })
+	}, true)
 }
 
 func (c *Client) ChangeProxyParsed(proxy string) {
-	c.cfg.proxies = []string{proxy}
-	rebindRoundtripper(c.fhttpClient, c.cfg)
+	c.reconfigure(func(cfg *Config) {
+		cfg.proxies = []string{proxy}
+	}, true)
 }
 
 func (c *Client) ChangeProxyListParsed(proxies []string) {
-	c.cfg.proxies = proxies
-	rebindRoundtripper(c.fhttpClient, c.cfg)
+	c.reconfigure(func(cfg *Config) {
+		cfg.proxies = append([]string{}, proxies...)
+	}, true)
 }
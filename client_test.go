@@ -1,15 +1,20 @@
 package http_client
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	http "github.com/vimbing/fhttp"
+	"github.com/vimbing/fhttp/cookiejar"
 	http2 "github.com/vimbing/fhttp/http2"
 	tls "github.com/vimbing/utls"
 )
@@ -229,7 +234,7 @@ func TestPostRequest(t *testing.T) {
 	for _, testCase := range testCases {
 		res, err := client.Post(
 			fmt.Sprintf("http://127.0.0.1:%d/json", testServerPort),
-			RequestJsonBody(testCase.object),
+			WithJSON(testCase.object),
 		)
 
 		if err != nil {
@@ -340,3 +345,179 @@ func TestProxyRotation(t *testing.T) {
 		}
 	}
 }
+
+func TestRequestTimeoutPhase(t *testing.T) {
+	testCases := []struct {
+		path          string
+		expectedPhase RequestPhase
+	}{
+		{path: "/timeout?timeoutMs=500", expectedPhase: PhaseResponseHeaders},
+		{path: "/slow-body?chunks=10&delayMs=50", expectedPhase: PhaseBodyRead},
+	}
+
+	for _, testCase := range testCases {
+		client := MustNew(
+			WithCustomTimeout(150 * time.Millisecond),
+		)
+
+		_, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d%s", testServerPort, testCase.path))
+
+		if !errors.Is(err, ErrRequestTimedOut) {
+			t.Fatalf("Expected ErrRequestTimedOut for %s, got: %v", testCase.path, err)
+		}
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected error to wrap context.DeadlineExceeded for %s, got: %v", testCase.path, err)
+		}
+
+		var timeoutErr *TimeoutError
+
+		if !errors.As(err, &timeoutErr) {
+			t.Fatalf("Expected *TimeoutError for %s, got: %T", testCase.path, err)
+		}
+
+		if timeoutErr.Phase != testCase.expectedPhase {
+			t.Errorf("Unexpected timeout phase for %s, expected: %s got: %s", testCase.path, testCase.expectedPhase, timeoutErr.Phase)
+		}
+	}
+}
+
+func TestTimedOutRequestIsAbandoned(t *testing.T) {
+	var middlewareCalls atomic.Int64
+
+	client := MustNew(
+		WithCustomTimeout(100*time.Millisecond),
+		WithResponseMiddleware(func(r *Response) error {
+			middlewareCalls.Add(1)
+			return nil
+		}),
+		WithResponseErrorMiddleware(func(r *Request, err error) {
+			middlewareCalls.Add(1)
+		}),
+	)
+
+	abortedBefore := testServerAborted.Load()
+
+	_, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/slow-body?chunks=20&delayMs=20", testServerPort))
+
+	if !errors.Is(err, ErrRequestTimedOut) {
+		t.Fatalf("Expected request to time out, got: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+
+	for testServerAborted.Load() == abortedBefore && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if testServerAborted.Load() == abortedBefore {
+		t.Errorf("Server never noticed the abandoned request, connection was left open")
+	}
+
+	// give a leaked goroutine the time it would need to finish the body
+	time.Sleep(500 * time.Millisecond)
+
+	if calls := middlewareCalls.Load(); calls != 0 {
+		t.Errorf("Middleware ran %d times for an abandoned request", calls)
+	}
+}
+
+func TestConcurrentUseAndReconfiguration(t *testing.T) {
+	jar, _ := cookiejar.New(nil)
+
+	clients := []*Client{
+		MustNew(WithTlsProfile(chrome140Profile())),
+		MustNew(WithTlsProfile(chrome140Profile()), WithForcedProxyRotation()),
+	}
+
+	for _, client := range clients {
+		var wg sync.WaitGroup
+
+		pingUrl := fmt.Sprintf("http://127.0.0.1:%d/ping", testServerPort)
+		parsedUrl, _ := url.Parse(pingUrl)
+
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for j := 0; j < 20; j++ {
+					res, err := client.Get(pingUrl)
+
+					if err != nil {
+						t.Errorf("Unexpected error while pinging test server: %v", err)
+						return
+					}
+
+					if res.BodyString() != "pong" {
+						t.Errorf("Unexpected body from test server: %s", res.BodyString())
+					}
+				}
+			}()
+		}
+
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+
+			go func(i int) {
+				defer wg.Done()
+
+				for j := 0; j < 20; j++ {
+					switch (i + j) % 7 {
+					case 0:
+						client.UseRequest(func(r *Request) error { return nil })
+					case 1:
+						client.UseResponse(func(r *Response) error { return nil })
+					case 2:
+						client.UseResponseError(func(r *Request, err error) {})
+					case 3:
+						client.DisableProxy()
+					case 4:
+						if err := client.RotateProxy(); err != nil {
+							t.Errorf("Unexpected error while rotating proxy: %v", err)
+						}
+					case 5:
+						client.BindJar(jar)
+					case 6:
+						client.AddCookieSimple(parsedUrl, "foo", "bar")
+						client.GetCookies(parsedUrl)
+					}
+				}
+			}(i)
+		}
+
+		wg.Wait()
+	}
+}
+
+func TestInFlightRequestKeepsConfigSnapshot(t *testing.T) {
+	client := MustNew(
+		WithTlsProfile(chrome140Profile()),
+	)
+
+	errLateMiddleware := errors.New("late middleware")
+
+	resultChan := make(chan error, 1)
+
+	go func() {
+		_, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/timeout?timeoutMs=300", testServerPort))
+		resultChan <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client.UseResponse(func(r *Response) error {
+		return errLateMiddleware
+	})
+
+	if err := <-resultChan; err != nil {
+		t.Fatalf("In-flight request picked up middleware registered after it started: %v", err)
+	}
+
+	_, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/ping", testServerPort))
+
+	if !errors.Is(err, errLateMiddleware) {
+		t.Fatalf("New request did not pick up the registered middleware, got: %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package http_client
+
+import (
+	"crypto/x509"
+	"net"
+
+	"github.com/vimbing/fhttp/httptrace"
+	tls "github.com/vimbing/utls"
+)
+
+// ConnInfo describes the connection a response was received on.
+type ConnInfo struct {
+	// NegotiatedProtocol is "h2" or "http/1.1".
+	NegotiatedProtocol string
+
+	// TLS is false for plain HTTP connections, the TLS fields are zero
+	// then.
+	TLS              bool
+	TLSVersion       uint16
+	CipherSuite      uint16
+	PeerCertificates []*x509.Certificate
+	DidResume        bool
+
+	// ECHAccepted reports whether the server accepted the Encrypted Client
+	// Hello, false for GREASE ECH and plain connections.
+	ECHAccepted bool
+
+	// RemoteAddr is the address the client is connected to, which is the
+	// proxy's when the request went through one.
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+
+	// Proxy is the proxy the connection goes through with its password
+	// redacted, empty for direct connections.
+	Proxy string
+
+	// Reused reports whether the connection had served requests before.
+	Reused bool
+}
+
+type connectionStater interface {
+	ConnectionState() tls.ConnectionState
+}
+
+func newConnInfo(info httptrace.GotConnInfo) ConnInfo {
+	connInfo := ConnInfo{
+		RemoteAddr: info.Conn.RemoteAddr(),
+		LocalAddr:  info.Conn.LocalAddr(),
+		Reused:     info.Reused,
+	}
+
+	if stater, ok := info.Conn.(connectionStater); ok {
+		state := stater.ConnectionState()
+
+		connInfo.TLS = true
+		connInfo.NegotiatedProtocol = state.NegotiatedProtocol
+		connInfo.TLSVersion = state.Version
+		connInfo.CipherSuite = state.CipherSuite
+		connInfo.PeerCertificates = state.PeerCertificates
+		connInfo.DidResume = state.DidResume
+		connInfo.ECHAccepted = state.ECHAccepted
+	}
+
+	return connInfo
+}
+
+// ConnInfo returns details of the connection the response arrived on.
+func (r *Response) ConnInfo() ConnInfo {
+	return r.connInfo
+}
@@ -0,0 +1,80 @@
+package http_client
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	tls "github.com/vimbing/utls"
+)
+
+func TestConnInfoTLS(t *testing.T) {
+	client := MustNew(
+		WithInsecureSkipVerify(),
+		WithTlsProfile(chrome140Profile()),
+	)
+
+	url := fmt.Sprintf("https://127.0.0.1:%d/ping", testTLSServerPort)
+
+	for i, expectedReused := range []bool{false, true} {
+		res, err := client.Get(url)
+
+		if err != nil {
+			t.Fatalf("Unexpected error while getting test server: %v", err)
+		}
+
+		info := res.ConnInfo()
+
+		if info.Reused != expectedReused {
+			t.Errorf("Unexpected Reused for request %d, expected: %t", i, expectedReused)
+		}
+
+		if !info.TLS || info.NegotiatedProtocol != "h2" || info.TLSVersion != tls.VersionTLS13 || info.CipherSuite == 0 {
+			t.Errorf("Unexpected TLS details: %+v", info)
+		}
+
+		if info.DidResume {
+			t.Errorf("Fresh session reported as resumed")
+		}
+
+		if len(info.PeerCertificates) == 0 || !info.PeerCertificates[0].Equal(testTLSServerCert) {
+			t.Errorf("Peer certificate does not match the test server certificate")
+		}
+
+		if info.RemoteAddr.(*net.TCPAddr).Port != testTLSServerPort || info.LocalAddr == nil {
+			t.Errorf("Unexpected addresses, remote: %v local: %v", info.RemoteAddr, info.LocalAddr)
+		}
+
+		if len(info.Proxy) != 0 {
+			t.Errorf("Unexpected proxy for direct connection: %s", info.Proxy)
+		}
+	}
+}
+
+func TestConnInfoPlainHTTPThroughProxy(t *testing.T) {
+	proxyAddr := startConnectProxy(t)
+
+	client := MustNew(
+		WithProxyParsed(fmt.Sprintf("http://user:secret@%s", proxyAddr)),
+	)
+
+	res, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/ping", testServerPort))
+
+	if err != nil {
+		t.Fatalf("Unexpected error while getting test server through proxy: %v", err)
+	}
+
+	info := res.ConnInfo()
+
+	if info.TLS || info.NegotiatedProtocol != "http/1.1" {
+		t.Errorf("Unexpected protocol details: %+v", info)
+	}
+
+	if expected := fmt.Sprintf("http://user:xxxxx@%s", proxyAddr); info.Proxy != expected {
+		t.Errorf("Unexpected proxy, expected: %s got: %s", expected, info.Proxy)
+	}
+
+	if info.RemoteAddr.String() != proxyAddr {
+		t.Errorf("Unexpected remote address, expected the proxy %s got: %v", proxyAddr, info.RemoteAddr)
+	}
+}
@@ -6,16 +6,22 @@ import (
 	http "github.com/vimbing/fhttp"
 )
 
+func (c *Client) jar() http.CookieJar {
+	return c.snapshot().fhttpClient.Jar
+}
+
 func (c *Client) GetCookies(u *url.URL) []*http.Cookie {
-	if c.fhttpClient.Jar == nil {
+	jar := c.jar()
+
+	if jar == nil {
 		return []*http.Cookie{}
 	}
 
-	return c.fhttpClient.Jar.Cookies(u)
+	return jar.Cookies(u)
 }
 
 func (c *Client) GetCookieByName(u *url.URL, name string) *http.Cookie {
-	if c.fhttpClient.Jar == nil {
+	if c.jar() == nil {
 		return nil
 	}
 
@@ -45,7 +51,7 @@ func (c *Client) RemoveCookie(u *url.URL, name string) {
 		}
 	}
 
-	c.fhttpClient.Jar.SetCookies(u, cookies)
+	c.jar().SetCookies(u, cookies)
 }
 
 func (c *Client) AddCookieSimple(u *url.URL, name, value string) {
@@ -55,11 +61,11 @@ func (c *Client) AddCookieSimple(u *url.URL, name, value string) {
 func (c *Client) AddCookie(u *url.URL, cookie *http.Cookie) {
 	cookies := []*http.Cookie{}
 	cookies = append(cookies, cookie)
-	c.fhttpClient.Jar.SetCookies(u, cookies)
+	c.jar().SetCookies(u, cookies)
 }
 
 func (c *Client) UpdateCookieSimple(u *url.URL, name, value string) {
-	if c.fhttpClient.Jar == nil {
+	if c.jar() == nil {
 		return
 	}
 
@@ -68,7 +74,7 @@ func (c *Client) UpdateCookieSimple(u *url.URL, name, value string) {
 }
 
 func (c *Client) UpdateCookie(u *url.URL, cookie *http.Cookie) {
-	if c.fhttpClient.Jar == nil {
+	if c.jar() == nil {
 		return
 	}
 
@@ -77,7 +83,7 @@ func (c *Client) UpdateCookie(u *url.URL, cookie *http.Cookie) {
 }
 
 func (c *Client) ClearAllCookies(u *url.URL) {
-	if c.fhttpClient.Jar == nil {
+	if c.jar() == nil {
 		return
 	}
 
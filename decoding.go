@@ -11,6 +11,19 @@ import (
 	http "github.com/vimbing/fhttp"
 )
 
+// hasResponseBody reports whether a response to method with status carries
+// a body.
+func hasResponseBody(method string, status int) bool {
+	switch {
+	case method == http.MethodHead:
+		return false
+	case status >= 100 && status < 200, status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+
+	return true
+}
+
 func decodeResponseBody(headers http.Header, body io.Reader) (io.Reader, error) {
 	var encoding string
 
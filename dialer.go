@@ -0,0 +1,250 @@
+package http_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/samber/lo"
+	"golang.org/x/net/proxy"
+)
+
+// fallbackDelay is how long the preferred address family gets before the
+// other one is tried in parallel, as recommended by RFC 8305.
+const fallbackDelay = 300 * time.Millisecond
+
+// directDialer dials without a proxy. Name resolution and the TCP dial are
+// done as separate steps so each can be bounded by its own timeout.
+type directDialer struct {
+	timeouts   Timeouts
+	resolver   Resolver
+	localAddrs *LocalAddrPool
+	ipFamily   IPFamily
+}
+
+func newDirectDialer(cfg *Config) *directDialer {
+	resolver := cfg.resolver
+
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	return &directDialer{
+		timeouts:   cfg.timeouts,
+		resolver:   resolver,
+		localAddrs: cfg.localAddrs,
+		ipFamily:   cfg.ipFamily,
+	}
+}
+
+func (d *directDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *directDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	timeouts := contextTimeouts(ctx, d.timeouts)
+
+	host, port, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := d.lookup(ctx, timeouts, host)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ips = lo.Filter(ips, func(ip net.IPAddr, _ int) bool { return d.ipFamily.allows(ip.IP) })
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses of the allowed family found for host %s", host)
+	}
+
+	dialCtx, cancel := phaseContext(ctx, PhaseDial, timeouts.Dial)
+	defer cancel()
+
+	primaries, fallbacks := ips, []net.IPAddr{}
+
+	if d.ipFamily == IPFamilyAuto {
+		primaries, fallbacks = partitionByFamily(ips)
+	}
+
+	conn, err := d.dialParallel(dialCtx, network, port, primaries, fallbacks)
+	err = phaseErr(dialCtx, err)
+
+	connectDone(ctx, ConnectDoneInfo{Network: network, Addr: addr, Err: err})
+
+	return conn, err
+}
+
+// dialParallel gives primaries a head start of fallbackDelay and then races
+// them against fallbacks, returning the first connection established.
+func (d *directDialer) dialParallel(ctx context.Context, network, port string, primaries, fallbacks []net.IPAddr) (net.Conn, error) {
+	if len(fallbacks) == 0 {
+		return d.dialSerial(ctx, network, port, primaries)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+
+	results := make(chan dialResult, 2)
+
+	race := func(ips []net.IPAddr) {
+		conn, err := d.dialSerial(ctx, network, port, ips)
+		results <- dialResult{conn: conn, err: err}
+	}
+
+	go race(primaries)
+
+	fallbackTimer := time.NewTimer(fallbackDelay)
+	defer fallbackTimer.Stop()
+
+	var firstErr error
+	pending := 1
+	fallbackStarted := false
+
+	for {
+		select {
+		case <-fallbackTimer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go race(fallbacks)
+			}
+		case result := <-results:
+			pending--
+
+			if result.err == nil {
+				// the loser may still connect, make sure it gets closed
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+
+				return result.conn, nil
+			}
+
+			if firstErr == nil {
+				firstErr = result.err
+			}
+
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go race(fallbacks)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+func (d *directDialer) dialSerial(ctx context.Context, network, port string, ips []net.IPAddr) (net.Conn, error) {
+	var firstErr error
+
+	for _, ip := range ips {
+		localAddr, ok := d.localAddrs.pick(ip.IP)
+
+		if !ok {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("no local address of the same family as %s", ip.String())
+			}
+
+			continue
+		}
+
+		dialer := &net.Dialer{KeepAlive: 30 * time.Second}
+
+		if localAddr != nil {
+			dialer.LocalAddr = localAddr
+		}
+
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+
+		if err == nil {
+			return conn, nil
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, firstErr
+}
+
+// partitionByFamily splits ips into the family of the first address and the
+// rest, keeping the resolver's order within each.
+func partitionByFamily(ips []net.IPAddr) (primaries, fallbacks []net.IPAddr) {
+	primaryIsIPv4 := ips[0].IP.To4() != nil
+
+	for _, ip := range ips {
+		if (ip.IP.To4() != nil) == primaryIsIPv4 {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+
+	return primaries, fallbacks
+}
+
+func (d *directDialer) lookup(ctx context.Context, timeouts Timeouts, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+
+	dnsCtx, cancel := phaseContext(ctx, PhaseDNS, timeouts.DNS)
+	defer cancel()
+
+	dnsStart(ctx, host)
+
+	ips, err := d.resolver.LookupIPAddr(dnsCtx, host)
+
+	if err != nil {
+		return nil, phaseErr(dnsCtx, err)
+	}
+
+	if len(ips) == 0 {
+		return nil, errors.New("no addresses found for host " + host)
+	}
+
+	return ips, nil
+}
+
+// phaseResetDialer re-enters phase once the wrapped dialer has connected, for
+// protocols that carry on with a handshake over the fresh connection.
+type phaseResetDialer struct {
+	dialer proxy.ContextDialer
+	phase  RequestPhase
+}
+
+func (d *phaseResetDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *phaseResetDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, addr)
+
+	if err == nil {
+		enterPhase(ctx, d.phase)
+	}
+
+	return conn, err
+}
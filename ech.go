@@ -0,0 +1,247 @@
+package http_client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ECHResolver is implemented by resolvers that can fetch the ECHConfigList a
+// host publishes in its DNS HTTPS record, see WithECHFromDNS.
+type ECHResolver interface {
+	// LookupECHConfigList returns nil without an error when host does not
+	// publish ECH configs.
+	LookupECHConfigList(ctx context.Context, host string) ([]byte, error)
+}
+
+type echConfigList struct {
+	hostPattern string
+	configList  []byte
+}
+
+// echConfigList returns the ECH configs to offer host, configured ones take
+// precedence over DNS.
+func (o tlsOptions) echConfigList(ctx context.Context, host string, timeouts Timeouts) ([]byte, error) {
+	for _, configs := range o.echConfigs {
+		if matchHost(configs.hostPattern, host) {
+			return configs.configList, nil
+		}
+	}
+
+	if o.echResolver == nil {
+		return nil, nil
+	}
+
+	lookupCtx, cancel := phaseContext(ctx, PhaseDNS, timeouts.DNS)
+	defer cancel()
+
+	configList, err := o.echResolver.LookupECHConfigList(lookupCtx, host)
+
+	// like browsers, a failed lookup leaves the profile's GREASE ECH in
+	// place instead of failing the connection
+	if err != nil && ctx.Err() != nil {
+		return nil, phaseErr(lookupCtx, err)
+	}
+
+	return configList, nil
+}
+
+// echCapable reports whether r can fetch ECH configs, resolvers wrapping
+// another one only can when the wrapped one does.
+func echCapable(r Resolver) bool {
+	switch r := r.(type) {
+	case *StaticResolver:
+		return echCapable(r.Fallback)
+	case *CachingResolver:
+		return echCapable(r.Resolver)
+	}
+
+	_, ok := r.(ECHResolver)
+
+	return ok
+}
+
+func (r *StaticResolver) LookupECHConfigList(ctx context.Context, host string) ([]byte, error) {
+	if resolver, ok := r.Fallback.(ECHResolver); ok {
+		return resolver.LookupECHConfigList(ctx, host)
+	}
+
+	return nil, nil
+}
+
+func (r *CachingResolver) LookupECHConfigList(ctx context.Context, host string) ([]byte, error) {
+	if resolver, ok := r.Resolver.(ECHResolver); ok {
+		return resolver.LookupECHConfigList(ctx, host)
+	}
+
+	return nil, nil
+}
+
+// typeHTTPS is the HTTPS resource record type from RFC 9460, dnsmessage has
+// no constant for it.
+const typeHTTPS dnsmessage.Type = 65
+
+// svcParamECH is the SvcParamKey carrying an ECHConfigList.
+const svcParamECH = 5
+
+// echLookupFailureTTL is how long a failed HTTPS lookup is cached, every
+// connection to the host would wait for it to fail again otherwise.
+const echLookupFailureTTL = 30 * time.Second
+
+type cachedECHConfigList struct {
+	configList []byte
+	err        error
+	expires    time.Time
+}
+
+// LookupECHConfigList fetches the HTTPS record of host, answers are cached
+// for their TTL and failures for echLookupFailureTTL.
+func (r *DoHResolver) LookupECHConfigList(ctx context.Context, host string) ([]byte, error) {
+	key := strings.ToLower(host)
+
+	r.mu.Lock()
+	entry, ok := r.echConfigs[key]
+	r.mu.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return entry.configList, entry.err
+	}
+
+	configList, ttl, err := r.lookupECHConfigList(ctx, host)
+
+	// a lookup cut short by the caller says nothing about the host
+	if err != nil && ctx.Err() != nil {
+		return nil, err
+	}
+
+	if err != nil {
+		ttl = echLookupFailureTTL
+	}
+
+	if ttl > 0 {
+		r.mu.Lock()
+
+		if r.echConfigs == nil {
+			r.echConfigs = make(map[string]cachedECHConfigList)
+		}
+
+		r.echConfigs[key] = cachedECHConfigList{configList: configList, err: err, expires: time.Now().Add(ttl)}
+		r.mu.Unlock()
+	}
+
+	return configList, err
+}
+
+func (r *DoHResolver) lookupECHConfigList(ctx context.Context, host string) ([]byte, time.Duration, error) {
+	msg, err := r.query(ctx, host, typeHTTPS)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return httpsECHConfigList(msg)
+}
+
+// httpsECHConfigList returns the ECHConfigList of the first HTTPS record of
+// msg that has one and how long the answer may be cached, the lowest TTL of
+// the records or, without records, the negative caching TTL of RFC 2308.
+func httpsECHConfigList(msg *dnsmessage.Message) ([]byte, time.Duration, error) {
+	var configList []byte
+	var ttl uint32
+	found := false
+
+	lower := func(value uint32) {
+		if !found || value < ttl {
+			ttl = value
+		}
+
+		found = true
+	}
+
+	for _, answer := range msg.Answers {
+		body, ok := answer.Body.(*dnsmessage.UnknownResource)
+
+		if !ok || body.Type != typeHTTPS {
+			continue
+		}
+
+		lower(answer.Header.TTL)
+
+		if configList != nil {
+			continue
+		}
+
+		var err error
+
+		if configList, err = svcbECHConfigList(body.Data); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if !found {
+		for _, authority := range msg.Authorities {
+			if soa, ok := authority.Body.(*dnsmessage.SOAResource); ok {
+				lower(min(authority.Header.TTL, soa.MinTTL))
+			}
+		}
+	}
+
+	return configList, time.Duration(ttl) * time.Second, nil
+}
+
+var errMalformedSVCB = errors.New("malformed HTTPS record")
+
+// svcbECHConfigList extracts the ech parameter of the SVCB style record data,
+// nil when the record is in alias mode or has no ech parameter.
+func svcbECHConfigList(data []byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, errMalformedSVCB
+	}
+
+	// alias mode records only point to another name
+	if binary.BigEndian.Uint16(data) == 0 {
+		return nil, nil
+	}
+
+	// the target name is never compressed in the record data
+	offset := 2
+
+	for {
+		if offset >= len(data) {
+			return nil, errMalformedSVCB
+		}
+
+		labelLen := int(data[offset])
+		offset += 1 + labelLen
+
+		if labelLen == 0 {
+			break
+		}
+	}
+
+	for offset+4 <= len(data) {
+		key := binary.BigEndian.Uint16(data[offset:])
+		valueLen := int(binary.BigEndian.Uint16(data[offset+2:]))
+		offset += 4
+
+		if offset+valueLen > len(data) {
+			return nil, errMalformedSVCB
+		}
+
+		if key == svcParamECH {
+			return data[offset : offset+valueLen], nil
+		}
+
+		offset += valueLen
+	}
+
+	if offset != len(data) {
+		return nil, errMalformedSVCB
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,310 @@
+package http_client
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newECHServer starts a TLS server that accepts ECH with the returned
+// ECHConfigList and answers whether the request arrived through it.
+func newECHServer(t *testing.T) (*httptest.Server, []byte) {
+	return newECHServerRetrying(t, true)
+}
+
+// newECHServerRetrying is newECHServer, sendAsRetry tells whether the server
+// sends its configs back when it rejects ECH.
+func newECHServerRetrying(t *testing.T, sendAsRetry bool) (*httptest.Server, []byte) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatalf("Unexpected error while generating ECH key: %v", err)
+	}
+
+	config := marshalECHConfig(1, key.PublicKey().Bytes(), "public.test")
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strconv.FormatBool(r.TLS.ECHAccepted)))
+	}))
+	server.TLS = &stdtls.Config{
+		EncryptedClientHelloKeys: []stdtls.EncryptedClientHelloKey{
+			{Config: config, PrivateKey: key.Bytes(), SendAsRetry: sendAsRetry},
+		},
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	configList := binary.BigEndian.AppendUint16(nil, uint16(len(config)))
+
+	return server, append(configList, config...)
+}
+
+// marshalECHConfig encodes a draft-ietf-tls-esni-22 ECHConfig using
+// DHKEM(X25519, HKDF-SHA256) with HKDF-SHA256 and AES-128-GCM.
+func marshalECHConfig(id uint8, publicKey []byte, publicName string) []byte {
+	contents := []byte{id}
+	contents = binary.BigEndian.AppendUint16(contents, 0x0020)
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(publicKey)))
+	contents = append(contents, publicKey...)
+	contents = binary.BigEndian.AppendUint16(contents, 4)
+	contents = binary.BigEndian.AppendUint16(contents, 0x0001)
+	contents = binary.BigEndian.AppendUint16(contents, 0x0001)
+	contents = append(contents, 0, uint8(len(publicName)))
+	contents = append(contents, publicName...)
+	contents = binary.BigEndian.AppendUint16(contents, 0)
+
+	config := binary.BigEndian.AppendUint16(nil, 0xfe0d)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(contents)))
+
+	return append(config, contents...)
+}
+
+func TestECHConfigList(t *testing.T) {
+	server, configList := newECHServer(t)
+
+	resolver, _ := NewStaticResolver(map[string][]string{"ech.test": {"127.0.0.1"}}, nil)
+
+	testCases := []struct {
+		name             string
+		options          []any
+		expectedAccepted bool
+	}{
+		{name: "no config", options: []any{}, expectedAccepted: false},
+		{name: "exact host", options: []any{WithECHConfigList("ech.test", configList)}, expectedAccepted: true},
+		{name: "other host", options: []any{WithECHConfigList("other.test", configList)}, expectedAccepted: false},
+	}
+
+	for _, testCase := range testCases {
+		client := MustNew(
+			append(testCase.options, WithResolver(resolver), WithInsecureSkipVerify(), WithTlsProfile(chrome140Profile()))...,
+		)
+
+		res, err := client.Get(fmt.Sprintf("https://ech.test:%d/", server.Listener.Addr().(*net.TCPAddr).Port))
+
+		if err != nil {
+			t.Fatalf("Unexpected error for %s while getting ECH server: %v", testCase.name, err)
+		}
+
+		if res.BodyString() != strconv.FormatBool(testCase.expectedAccepted) {
+			t.Errorf("Unexpected server side ECH for %s, expected: %t got: %s", testCase.name, testCase.expectedAccepted, res.BodyString())
+		}
+
+		if res.ConnInfo().ECHAccepted != testCase.expectedAccepted {
+			t.Errorf("Unexpected ECHAccepted for %s, expected: %t", testCase.name, testCase.expectedAccepted)
+		}
+	}
+}
+
+func TestECHFromDNS(t *testing.T) {
+	server, configList := newECHServer(t)
+
+	testServerECHConfigList.Store(&configList)
+	defer testServerECHConfigList.Store(nil)
+
+	resolver := NewDoHResolver(fmt.Sprintf("http://127.0.0.1:%d/dns-query", testServerPort), nil)
+
+	client := MustNew(
+		WithResolver(resolver),
+		WithECHFromDNS(),
+		WithInsecureSkipVerify(),
+		WithTlsProfile(chrome140Profile()),
+	)
+
+	res, err := client.Get(fmt.Sprintf("https://ech.test:%d/", server.Listener.Addr().(*net.TCPAddr).Port))
+
+	if err != nil {
+		t.Fatalf("Unexpected error while getting ECH server: %v", err)
+	}
+
+	if !res.ConnInfo().ECHAccepted {
+		t.Errorf("Expected ECH from the HTTPS record to be accepted, server saw: %s", res.BodyString())
+	}
+	// the record is cached for its TTL
+	queriesBefore := testServerDNSQueries.Load()
+	cached, err := resolver.LookupECHConfigList(context.Background(), "ECH.test")
+
+	if err != nil || string(cached) != string(configList) || testServerDNSQueries.Load() != queriesBefore {
+		t.Errorf("Unexpected cached lookup %x: %v", cached, err)
+	}
+}
+
+func TestECHFromDNSLookupFailure(t *testing.T) {
+	server, _ := newECHServer(t)
+
+	var queries atomic.Int64
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	// the A record is pinned, the HTTPS lookup fails
+	doh := NewDoHResolver(failing.URL, nil)
+	resolver, _ := NewStaticResolver(map[string][]string{"ech.test": {"127.0.0.1"}}, doh)
+
+	client := MustNew(
+		WithResolver(resolver),
+		WithECHFromDNS(),
+		WithInsecureSkipVerify(),
+		WithTlsProfile(chrome140Profile()),
+	)
+
+	res, err := client.Get(fmt.Sprintf("https://ech.test:%d/", server.Listener.Addr().(*net.TCPAddr).Port))
+
+	if err != nil {
+		t.Fatalf("Unexpected error after a failed HTTPS lookup: %v", err)
+	}
+
+	if res.ConnInfo().ECHAccepted {
+		t.Errorf("Unexpected ECH without configs")
+	}
+
+	// the failure is cached, the host isn't looked up again
+	if _, err := doh.LookupECHConfigList(context.Background(), "ech.test"); err == nil || queries.Load() != 1 {
+		t.Errorf("Unexpected cached lookup after %d queries: %v", queries.Load(), err)
+	}
+}
+
+// staleECHConfigList returns an ECHConfigList for a key no server holds.
+func staleECHConfigList(publicName string) []byte {
+	key, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	config := marshalECHConfig(2, key.PublicKey().Bytes(), publicName)
+
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(config))), config...)
+}
+
+func TestECHRejected(t *testing.T) {
+	resolver, _ := NewStaticResolver(map[string][]string{"ech.test": {"127.0.0.1"}}, nil)
+
+	testCases := []struct {
+		name             string
+		sendAsRetry      bool
+		expectedAccepted bool
+	}{
+		{name: "retry configs", sendAsRetry: true, expectedAccepted: true},
+		{name: "no retry configs", sendAsRetry: false, expectedAccepted: false},
+	}
+
+	for _, testCase := range testCases {
+		server, _ := newECHServerRetrying(t, testCase.sendAsRetry)
+
+		client := MustNew(
+			WithECHConfigList("ech.test", staleECHConfigList("public.test")),
+			WithResolver(resolver),
+			WithInsecureSkipVerify(),
+			WithTlsProfile(chrome140Profile()),
+		)
+
+		res, err := client.Get(fmt.Sprintf("https://ech.test:%d/", server.Listener.Addr().(*net.TCPAddr).Port))
+
+		if err != nil {
+			t.Fatalf("Unexpected error for %s after ECH was rejected: %v", testCase.name, err)
+		}
+
+		if res.ConnInfo().ECHAccepted != testCase.expectedAccepted {
+			t.Errorf("Unexpected ECHAccepted for %s, expected: %t server saw: %s", testCase.name, testCase.expectedAccepted, res.BodyString())
+		}
+	}
+}
+
+func TestECHRejectedPublicName(t *testing.T) {
+	server, _ := newECHServer(t)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	// the test certificate is valid for example.com
+	resolver, _ := NewStaticResolver(map[string][]string{"example.com": {"127.0.0.1"}}, nil)
+
+	testCases := []struct {
+		publicName  string
+		expectError bool
+	}{
+		{publicName: "example.com", expectError: false},
+		{publicName: "public.test", expectError: true},
+	}
+
+	for _, testCase := range testCases {
+		client := MustNew(
+			WithECHConfigList("example.com", staleECHConfigList(testCase.publicName)),
+			WithResolver(resolver),
+			WithRootCAs(roots),
+			WithTlsProfile(chrome140Profile()),
+		)
+
+		_, err := client.Get(fmt.Sprintf("https://example.com:%d/", server.Listener.Addr().(*net.TCPAddr).Port))
+
+		if (err != nil) != testCase.expectError {
+			t.Errorf("Unexpected error for public name %s: %v", testCase.publicName, err)
+		}
+	}
+}
+
+func TestECHFromDNSResolver(t *testing.T) {
+	doh := NewDoHResolver(fmt.Sprintf("http://127.0.0.1:%d/dns-query", testServerPort), nil)
+	static, _ := NewStaticResolver(nil, nil)
+	staticDoH, _ := NewStaticResolver(nil, doh)
+
+	testCases := []struct {
+		name        string
+		resolver    Resolver
+		expectError bool
+	}{
+		{name: "system", resolver: nil, expectError: true},
+		{name: "static", resolver: static, expectError: true},
+		{name: "caching", resolver: NewCachingResolver(nil, time.Minute), expectError: true},
+		{name: "doh", resolver: doh, expectError: false},
+		{name: "static over doh", resolver: staticDoH, expectError: false},
+	}
+
+	for _, testCase := range testCases {
+		options := []any{WithECHFromDNS()}
+
+		if testCase.resolver != nil {
+			options = append(options, WithResolver(testCase.resolver))
+		}
+
+		if _, err := New(options...); (err != nil) != testCase.expectError {
+			t.Errorf("Unexpected error for %s: %v", testCase.name, err)
+		}
+	}
+}
+
+func TestSVCBECHConfigList(t *testing.T) {
+	testCases := []struct {
+		name        string
+		data        []byte
+		expected    []byte
+		expectError bool
+	}{
+		{name: "alias mode", data: []byte{0, 0, 0}, expected: nil},
+		{name: "no ech", data: []byte{0, 1, 0, 0, 1, 0, 2, 'h', '2'}, expected: nil},
+		{name: "ech after alpn", data: []byte{0, 1, 3, 'c', 'd', 'n', 0, 0, 1, 0, 2, 'h', '2', 0, 5, 0, 2, 0xab, 0xcd}, expected: []byte{0xab, 0xcd}},
+		{name: "truncated value", data: []byte{0, 1, 0, 0, 5, 0, 4, 0xab}, expectError: true},
+		{name: "truncated name", data: []byte{0, 1, 3, 'c'}, expectError: true},
+	}
+
+	for _, testCase := range testCases {
+		configList, err := svcbECHConfigList(testCase.data)
+
+		if (err != nil) != testCase.expectError {
+			t.Errorf("Unexpected error for %s: %v", testCase.name, err)
+		}
+
+		if string(configList) != string(testCase.expected) {
+			t.Errorf("Unexpected config list for %s, expected: %x got: %x", testCase.name, testCase.expected, configList)
+		}
+	}
+}
@@ -1,14 +1,56 @@
 package http_client
 
-import "errors"
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
 
 var (
-	ErrResponseNil          = errors.New("request ended up with nil response")
-	ErrRequestTimedOut      = errors.New("request timed out")
-	ErrProxyFormatCorrupted = errors.New("proxy format corrupted, cannot parse")
-	ErrRequestNotInitiated  = errors.New("request was not built yet")
+	ErrResponseNil           = errors.New("request ended up with nil response")
+	ErrRequestTimedOut       = errors.New("request timed out")
+	ErrProxyFormatCorrupted  = errors.New("proxy format corrupted, cannot parse")
+	ErrRequestNotInitiated   = errors.New("request was not built yet")
+	ErrDoHQueryFailed        = errors.New("dns over https query failed")
+	ErrProtocolNotNegotiated = errors.New("server did not negotiate the required protocol")
+	ErrUnknownOption         = errors.New("unknown option")
+	ErrInvalidFlow           = errors.New("invalid http2 connection flow")
 )
 
 var (
 	ErrRetryExceed = errors.New("retry max exceed")
 )
+
+func unknownOption(opt any) error {
+	return fmt.Errorf("%w of type %T", ErrUnknownOption, opt)
+}
+
+// TimeoutError reports the phase a request was in when its deadline passed.
+// It matches both ErrRequestTimedOut and context.DeadlineExceeded.
+type TimeoutError struct {
+	Phase RequestPhase
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%v during %s", ErrRequestTimedOut, e.Phase)
+}
+
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrRequestTimedOut
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// PinMismatchError is returned when none of the certificates presented by
+// Host matches the pins configured for it.
+type PinMismatchError struct {
+	Host  string
+	Chain []*x509.Certificate
+}
+
+func (e *PinMismatchError) Error() string {
+	return fmt.Sprintf("certificate chain presented by %s does not match any pin", e.Host)
+}
@@ -1,6 +1,7 @@
 package http_client
 
 import (
+	"context"
 	"errors"
 	"net"
 	"net/url"
@@ -13,7 +14,33 @@ import (
 	"golang.org/x/net/proxy"
 )
 
-func socksDialer(pickedProxy string) (proxy.ContextDialer, error) {
+// socksProxyDialer bounds the SOCKS handshake by the proxy connect timeout,
+// the TCP dial to the proxy goes through the direct dialer.
+type socksProxyDialer struct {
+	dialer   proxy.ContextDialer
+	timeouts Timeouts
+	proxy    string
+}
+
+func (d *socksProxyDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *socksProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	timeouts := contextTimeouts(ctx, d.timeouts)
+
+	connectCtx, cancel := phaseContext(ctx, PhaseProxyConnect, timeouts.ProxyConnect)
+	defer cancel()
+
+	conn, err := d.dialer.DialContext(connectCtx, network, addr)
+	err = phaseErr(connectCtx, err)
+
+	connectDone(ctx, ConnectDoneInfo{Network: network, Addr: addr, Proxy: d.proxy, Err: err})
+
+	return conn, err
+}
+
+func socksDialer(pickedProxy string, cfg *Config) (proxy.ContextDialer, error) {
 	proxyUrl, err := url.Parse(pickedProxy)
 
 	if err != nil {
@@ -34,10 +61,12 @@ func socksDialer(pickedProxy string) (proxy.ContextDialer, error) {
 		}
 	}
 
-	dialSocksProxy, err := proxy.SOCKS5("tcp", proxyUrl.Host, auth, &net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
-	})
+	forward := &phaseResetDialer{
+		dialer: cfg.baseDialer(),
+		phase:  PhaseProxyConnect,
+	}
+
+	dialSocksProxy, err := proxy.SOCKS5("tcp", proxyUrl.Host, auth, forward)
 
 	if err != nil {
 		return nil, err
@@ -51,46 +80,48 @@ func socksDialer(pickedProxy string) (proxy.ContextDialer, error) {
 		return nil, errors.New("failed type assertion to DialContext")
 	}
 
-	return dialer, nil
+	return &socksProxyDialer{
+		dialer:   dialer,
+		timeouts: cfg.timeouts,
+		proxy:    proxyUrl.Redacted(),
+	}, nil
 }
 
 func rebindRoundtripper(c *http.Client, cfg *Config) error {
 	return retry.Retrier{Max: 3, Delay: time.Second * 0}.Retry(func() error {
 		var dialer proxy.ContextDialer
+		var pickedProxy string
 		var err error
 
 		if len(cfg.proxies) > 0 {
-			pickedProxy := cfg.proxies[RandomInt(0, len(cfg.proxies))]
+			pickedProxy = cfg.proxies[RandomInt(0, len(cfg.proxies))]
 
 			if strings.Contains(cfg.proxies[0], "socks") {
-				dialer, err = socksDialer(pickedProxy)
+				dialer, err = socksDialer(pickedProxy, cfg)
 			} else {
-				dialer, err = newConnectDialer(pickedProxy)
+				dialer, err = newConnectDialer(pickedProxy, cfg)
 			}
 		} else {
-			dialer = proxy.Direct
+			dialer = cfg.baseDialer()
 		}
 
 		if err != nil {
 			return err
 		}
 
-		c.Transport = newRoundTripper(roundTripperSettings{
-			clientHello:        cfg.transportSettings.HelloID,
-			insecureSkipVerify: cfg.insecureSkipVerify,
-			dialer:             dialer,
-			http2Settings:      cfg.transportSettings.Http2Settings.Settings,
-			http2SettingsOrder: cfg.transportSettings.Http2Settings.Order,
-		})
+		// sockets are local, they never go through the proxy
+		dialer = &unixSocketDialer{dialer: dialer, timeouts: cfg.timeouts}
+
+		c.Transport = newProfileRoundTripper(cfg, dialer, pickedProxy)
 
 		return nil
 	})
 }
 
 func newFhttpClient(cfg *Config) (*http.Client, error) {
-	client := &http.Client{
-		Timeout: cfg.timeout,
-	}
+	// The request deadline is enforced through the request context, see
+	// Timeouts, so the client timeout is left unset.
+	client := &http.Client{}
 
 	if !cfg.allowRedirect {
 		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
@@ -98,8 +129,6 @@ func newFhttpClient(cfg *Config) (*http.Client, error) {
 		}
 	}
 
-	client.Timeout = cfg.timeout
-
 	if err := rebindRoundtripper(client, cfg); err != nil {
 		return client, err
 	}
@@ -13,12 +13,14 @@ require (
 	github.com/vimbing/fhttp v0.0.0-20251004215231-348b09dcfb0f
 	github.com/vimbing/retry v0.0.0-20240429231038-75d39d3774db
 	github.com/vimbing/utls v0.0.0-20251006211133-eb050806c8cf
-	golang.org/x/net v0.38.0
+	golang.org/x/net v0.43.0
 )
 
 require (
-	golang.org/x/crypto v0.36.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
 	golang.org/x/exp v0.0.0-20220303212507-bbda1eaf7a17 // indirect
-	golang.org/x/sys v0.31.0 // indirect
-	golang.org/x/text v0.23.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
 )
+
+replace github.com/vimbing/fhttp => ./third_party/fhttp
@@ -0,0 +1,198 @@
+package http_client
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	http "github.com/vimbing/fhttp"
+	"github.com/vimbing/fhttp/http2"
+)
+
+// H2CMode selects whether http:// requests may use HTTP/2 in cleartext.
+type H2CMode int
+
+const (
+	// H2COff speaks HTTP/1.1 to http:// URLs.
+	H2COff H2CMode = iota
+	// H2CPriorKnowledge speaks HTTP/2 right away, for servers known to
+	// accept it.
+	H2CPriorKnowledge
+	// H2CUpgrade asks every new server to upgrade from HTTP/1.1 and keeps
+	// using HTTP/1.1 with the ones that decline.
+	H2CUpgrade
+)
+
+// h2cMode returns the cleartext mode of rt, a required HTTP/2 implies prior
+// knowledge unless the upgrade was chosen.
+func (rt *roundTripper) h2cMode() H2CMode {
+	switch rt.protocol {
+	case ProtocolHTTP1:
+		return H2COff
+	case ProtocolHTTP2:
+		if rt.h2c == H2COff {
+			return H2CPriorKnowledge
+		}
+	}
+
+	return rt.h2c
+}
+
+// getCleartextTransport picks the transport for the http:// address addr.
+// Like for ALPN the connection used to decide is stashed for the request.
+func (rt *roundTripper) getCleartextTransport(req *http.Request, addr string) error {
+	t1 := rt.newHTTP1Transport()
+	t1.DialContext = rt.dialContext
+
+	var transport http.RoundTripper = t1
+
+	if mode := rt.h2cMode(); mode != H2COff {
+		conn, err := rt.dialH2CContext(req.Context(), "tcp", addr, mode)
+
+		switch {
+		case err == nil:
+			// With AllowHTTP requests start on stream 3, after an upgrade
+			// stream 1 carries the probe and its response is discarded.
+			t2 := rt.newHTTP2Transport()
+			t2.AllowHTTP = true
+			transport = rt.newHTTP2Pool(t2, func(ctx context.Context) (net.Conn, error) {
+				return rt.dialH2C(ctx, addr)
+			})
+
+			rt.Lock()
+			rt.cachedConnections[addr] = conn
+			rt.Unlock()
+		case errors.Is(err, errH2CDeclined) && rt.protocol != ProtocolHTTP2:
+		default:
+			return err
+		}
+	}
+
+	rt.Lock()
+	defer rt.Unlock()
+
+	if rt.cachedTransports[addr] == nil {
+		rt.cachedTransports[addr] = transport
+	}
+
+	return nil
+}
+
+var errH2CDeclined = fmt.Errorf("%w: server declined the h2c upgrade", ErrProtocolNotNegotiated)
+
+func (rt *roundTripper) dialH2C(ctx context.Context, addr string) (net.Conn, error) {
+	rt.Lock()
+	if conn := rt.cachedConnections[addr]; conn != nil {
+		delete(rt.cachedConnections, addr)
+		rt.Unlock()
+		return conn, nil
+	}
+	rt.Unlock()
+
+	return rt.dialH2CContext(ctx, "tcp", addr, rt.h2cMode())
+}
+
+func (rt *roundTripper) dialH2CContext(ctx context.Context, network, addr string, mode H2CMode) (net.Conn, error) {
+	conn, err := rt.dialContext(ctx, network, addr)
+
+	if err != nil || mode != H2CUpgrade {
+		return conn, err
+	}
+
+	upgraded, err := rt.upgradeH2C(ctx, conn, addr)
+
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return upgraded, nil
+}
+
+// upgradeH2C sends an OPTIONS request asking the server to switch conn to
+// HTTP/2 and returns conn positioned after the 101 response. A probe is
+// used so the first real request is not sent twice.
+func (rt *roundTripper) upgradeH2C(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	host := strings.TrimSuffix(addr, ":80")
+
+	request := "OPTIONS / HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Connection: Upgrade, HTTP2-Settings\r\n" +
+		"Upgrade: h2c\r\n" +
+		"HTTP2-Settings: " + http2SettingsHeader(rt.newHTTP2Transport()) + "\r\n\r\n"
+
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusSwitchingProtocols || !strings.EqualFold(res.Header.Get("Upgrade"), "h2c") {
+		return nil, errH2CDeclined
+	}
+
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// http2SettingsHeader encodes the SETTINGS t2 sends as the value of the
+// HTTP2-Settings header.
+func http2SettingsHeader(t2 *http2.Transport) string {
+	settings := slices.Clone(t2.Settings)
+
+	has := func(id http2.SettingID) bool {
+		for _, setting := range settings {
+			if setting.ID == id {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if t2.HeaderTableSize != 0 && !has(http2.SettingHeaderTableSize) {
+		settings = append(settings, http2.Setting{ID: http2.SettingHeaderTableSize, Val: t2.HeaderTableSize})
+	}
+
+	if t2.InitialWindowSize != 0 && !has(http2.SettingInitialWindowSize) {
+		settings = append(settings, http2.Setting{ID: http2.SettingInitialWindowSize, Val: t2.InitialWindowSize})
+	}
+
+	payload := make([]byte, 0, 6*len(settings))
+
+	for _, setting := range settings {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(setting.ID))
+		payload = binary.BigEndian.AppendUint32(payload, setting.Val)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(payload)
+}
+
+// bufferedConn hands out the bytes read ahead while parsing the upgrade
+// response before reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,201 @@
+package http_client
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fhttp2 "github.com/vimbing/fhttp/http2"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// startH2CServer serves the protocol of every request over h2c and counts
+// the OPTIONS probes it receives.
+func startH2CServer(t *testing.T) (string, *atomic.Int64) {
+	var probes atomic.Int64
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			probes.Add(1)
+
+			// x/net writes the response to the upgrade request racing with
+			// the client's SETTINGS, let those arrive first
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		w.Write([]byte(r.Proto))
+	})
+
+	server := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	t.Cleanup(server.Close)
+
+	return server.URL, &probes
+}
+
+func TestH2CPriorKnowledge(t *testing.T) {
+	url, probes := startH2CServer(t)
+
+	client := MustNew(WithH2C(H2CPriorKnowledge))
+
+	for i := 0; i < 2; i++ {
+		res, err := client.Get(url)
+
+		if err != nil {
+			t.Fatalf("Unexpected error for request %d: %v", i, err)
+		}
+
+		if res.BodyString() != "HTTP/2.0" {
+			t.Errorf("Unexpected proto for request %d: %s", i, res.BodyString())
+		}
+
+		if info := res.ConnInfo(); info.NegotiatedProtocol != "h2" || info.TLS || info.Reused != (i > 0) {
+			t.Errorf("Unexpected connection for request %d: %+v", i, info)
+		}
+	}
+
+	if probes.Load() != 0 {
+		t.Errorf("Prior knowledge sent an upgrade probe")
+	}
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	url, probes := startH2CServer(t)
+
+	client := MustNew(WithH2C(H2CUpgrade))
+
+	for i := 0; i < 2; i++ {
+		res, err := client.Get(url)
+
+		if err != nil {
+			t.Fatalf("Unexpected error for request %d: %v", i, err)
+		}
+
+		if res.BodyString() != "HTTP/2.0" {
+			t.Errorf("Unexpected proto for request %d: %s", i, res.BodyString())
+		}
+	}
+
+	if probes.Load() != 1 {
+		t.Errorf("Expected a single upgrade probe, got: %d", probes.Load())
+	}
+}
+
+func TestH2CUpgradeDeclined(t *testing.T) {
+	client := MustNew(WithH2C(H2CUpgrade))
+
+	res, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/ping", testServerPort))
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if res.BodyString() != "pong" || res.ConnInfo().NegotiatedProtocol != "http/1.1" {
+		t.Errorf("Unexpected response: %s over %s", res.BodyString(), res.ConnInfo().NegotiatedProtocol)
+	}
+
+	req, err := client.NewRequest(fmt.Sprintf("http://localhost:%d/ping", testServerPort), "GET", nil, nil)
+
+	if err != nil {
+		t.Fatalf("Unexpected error while building request: %v", err)
+	}
+
+	req.SetProtocol(ProtocolHTTP2)
+
+	if _, err := client.Do(req); !errors.Is(err, ErrProtocolNotNegotiated) {
+		t.Errorf("Expected ErrProtocolNotNegotiated, got: %v", err)
+	}
+}
+
+func TestH2CRequestProtocol(t *testing.T) {
+	url, _ := startH2CServer(t)
+
+	client := MustNew()
+
+	req, err := client.NewRequest(url, "GET", nil, nil)
+
+	if err != nil {
+		t.Fatalf("Unexpected error while building request: %v", err)
+	}
+
+	req.SetProtocol(ProtocolHTTP2)
+
+	res, err := client.Do(req)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if res.BodyString() != "HTTP/2.0" {
+		t.Errorf("Unexpected proto: %s", res.BodyString())
+	}
+}
+
+func TestH2CSettings(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("Unexpected error while starting listener: %v", err)
+	}
+
+	defer listener.Close()
+
+	settingsChan := make(chan map[uint16]uint32, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			settingsChan <- nil
+			return
+		}
+
+		defer conn.Close()
+
+		preface := make([]byte, len(http2.ClientPreface)+9)
+
+		if _, err := io.ReadFull(conn, preface); err != nil {
+			settingsChan <- nil
+			return
+		}
+
+		header := preface[len(http2.ClientPreface):]
+		payload := make([]byte, int(header[0])<<16|int(header[1])<<8|int(header[2]))
+
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			settingsChan <- nil
+			return
+		}
+
+		settings := make(map[uint16]uint32)
+
+		for ; len(payload) >= 6; payload = payload[6:] {
+			settings[binary.BigEndian.Uint16(payload)] = binary.BigEndian.Uint32(payload[2:])
+		}
+
+		settingsChan <- settings
+	}()
+
+	profile := chrome140Profile()
+	profile.Http2Settings = TransportHttp2Settings{
+		Order:    []fhttp2.SettingID{fhttp2.SettingMaxConcurrentStreams, fhttp2.SettingMaxHeaderListSize},
+		Settings: map[fhttp2.SettingID]uint32{fhttp2.SettingMaxConcurrentStreams: 77, fhttp2.SettingMaxHeaderListSize: 4096},
+	}
+
+	client := MustNew(WithTlsProfile(profile), WithH2C(H2CPriorKnowledge))
+
+	go client.Get(fmt.Sprintf("http://%s/", listener.Addr()))
+
+	settings := <-settingsChan
+
+	if settings[uint16(fhttp2.SettingMaxConcurrentStreams)] != 77 || settings[uint16(fhttp2.SettingMaxHeaderListSize)] != 4096 {
+		t.Errorf("Unexpected SETTINGS: %v", settings)
+	}
+}
@@ -0,0 +1,64 @@
+package http_client
+
+import (
+	"context"
+
+	tls "github.com/vimbing/utls"
+)
+
+// Hooks are called as a request makes progress, from the goroutine doing
+// the work, so they have to be fast and safe for concurrent use. Any of
+// them may be nil.
+type Hooks struct {
+	// OnDNSStart is called before host is resolved, IP literals skip it.
+	OnDNSStart func(host string)
+
+	// OnConnectDone is called when a TCP connection is established or
+	// failed, and again when a proxy tunnel to the target is.
+	OnConnectDone func(info ConnectDoneInfo)
+
+	// OnTLSHandshakeDone is called after the handshake with the target,
+	// state is zero when err is set.
+	OnTLSHandshakeDone func(state tls.ConnectionState, err error)
+
+	// OnFirstByte is called when the first byte of the response arrives.
+	OnFirstByte func()
+}
+
+// ConnectDoneInfo describes a finished connection attempt.
+type ConnectDoneInfo struct {
+	Network string
+	Addr    string
+
+	// Proxy is the redacted URL of the proxy Addr was tunneled through,
+	// empty for plain TCP connections, including the one to the proxy.
+	Proxy string
+
+	Err error
+}
+
+func hooksFromContext(ctx context.Context) Hooks {
+	if exec := executionFromContext(ctx); exec != nil {
+		return exec.hooks
+	}
+
+	return Hooks{}
+}
+
+func dnsStart(ctx context.Context, host string) {
+	if hook := hooksFromContext(ctx).OnDNSStart; hook != nil {
+		hook(host)
+	}
+}
+
+func connectDone(ctx context.Context, info ConnectDoneInfo) {
+	if hook := hooksFromContext(ctx).OnConnectDone; hook != nil {
+		hook(info)
+	}
+}
+
+func tlsHandshakeDone(ctx context.Context, state tls.ConnectionState, err error) {
+	if hook := hooksFromContext(ctx).OnTLSHandshakeDone; hook != nil {
+		hook(state, err)
+	}
+}
@@ -0,0 +1,192 @@
+package http_client
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sync"
+	"sync/atomic"
+
+	http "github.com/vimbing/fhttp"
+	"golang.org/x/net/proxy"
+)
+
+type tlsProfileKey struct{}
+
+// requestProfile is a profile set on a request. Profiles without an ID are
+// told apart by seq, unique for the life of the process.
+type requestProfile struct {
+	TlsProfile
+	seq uint64
+}
+
+var requestProfileSeq atomic.Uint64
+
+// hostProfile maps the hosts matching a pattern to a profile.
+type hostProfile struct {
+	pattern string
+	regexp  *regexp.Regexp
+	profile TlsProfile
+}
+
+func (h hostProfile) matches(host string) bool {
+	if h.regexp != nil {
+		return h.regexp.MatchString(host)
+	}
+
+	return matchHost(h.pattern, host)
+}
+
+func (o OptionHostTlsProfile) parse() (hostProfile, error) {
+	hostProfile := hostProfile{pattern: o.pattern, profile: o.profile}
+
+	if err := validateFlow(o.profile.TransportSettings); err != nil {
+		return hostProfile, err
+	}
+
+	if o.regexp {
+		re, err := regexp.Compile(o.pattern)
+
+		if err != nil {
+			return hostProfile, fmt.Errorf("invalid host pattern %q: %w", o.pattern, err)
+		}
+
+		hostProfile.regexp = re
+	}
+
+	return hostProfile, nil
+}
+
+// maxProfileRoundTrippers bounds the round trippers a profileRoundTripper
+// keeps, the least recently used one is dropped and its idle connections
+// closed beyond it.
+const maxProfileRoundTrippers = 32
+
+// profileRoundTripper picks the profile of every request and hands it to a
+// roundTripper built for that profile. Each of them keeps its own
+// transports and connections, so hosts never share a connection across
+// profiles.
+type profileRoundTripper struct {
+	cfg    *Config
+	dialer proxy.ContextDialer
+
+	// proxy is the redacted URL of the proxy dialer goes through
+	proxy string
+
+	// proxyUrl is that URL unredacted, TLS sessions are kept apart per
+	// proxy
+	proxyUrl string
+
+	mu            sync.Mutex
+	roundTrippers *lruCache[string, *roundTripper]
+}
+
+func newProfileRoundTripper(cfg *Config, dialer proxy.ContextDialer, proxyUrl string) *profileRoundTripper {
+	return &profileRoundTripper{
+		cfg:           cfg,
+		dialer:        dialer,
+		proxy:         redactProxy(proxyUrl),
+		proxyUrl:      proxyUrl,
+		roundTrippers: newLRUCache[string, *roundTripper](maxProfileRoundTrippers),
+	}
+}
+
+func (p *profileRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, settings := p.settingsFor(req)
+	protocol := p.protocolFor(req)
+
+	if err := validateFlow(settings); err != nil {
+		return nil, err
+	}
+
+	// h1 only and auto connections to the same address must not share a
+	// transport, the preference is part of the key
+	return p.roundTripper(key+" "+protocol.String(), settings, protocol).RoundTrip(req)
+}
+
+// settingsFor returns the transport settings for req and a key naming them.
+// A profile set on the request wins over the host mapping, which wins over
+// the client's profile.
+func (p *profileRoundTripper) settingsFor(req *http.Request) (string, TransportSettings) {
+	if profile, ok := req.Context().Value(tlsProfileKey{}).(*requestProfile); ok {
+		if len(profile.ID) > 0 {
+			return "request " + profile.ID, profile.TransportSettings
+		}
+
+		// every request carries its own copy, which its redirects share
+		return fmt.Sprintf("request #%d", profile.seq), profile.TransportSettings
+	}
+
+	host := req.URL.Hostname()
+
+	for i, hostProfile := range p.cfg.hostProfiles {
+		if hostProfile.matches(host) {
+			return fmt.Sprintf("host %d", i), hostProfile.profile.TransportSettings
+		}
+	}
+
+	return "client", p.cfg.transportSettings
+}
+
+// protocolFor returns the protocol preference of req, falling back to the
+// client's.
+func (p *profileRoundTripper) protocolFor(req *http.Request) Protocol {
+	if protocol, ok := req.Context().Value(protocolKey{}).(Protocol); ok {
+		return protocol
+	}
+
+	return p.cfg.protocol
+}
+
+func (p *profileRoundTripper) roundTripper(key string, settings TransportSettings, protocol Protocol) http.RoundTripper {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if rt, ok := p.roundTrippers.get(key); ok {
+		return rt
+	}
+
+	rt := newRoundTripper(roundTripperSettings{
+		clientHello:        settings.HelloID,
+		clientHelloSpec:    settings.Spec,
+		helloShaping:       p.cfg.helloShaping(settings, protocol),
+		protocol:           protocol,
+		h2c:                p.cfg.h2c,
+		tlsOptions:         p.cfg.tlsOptions(settings, p.proxyUrl),
+		insecureSkipVerify: p.cfg.insecureSkipVerify,
+		dialer:             p.dialer,
+		http2Settings:      settings.Http2Settings.Settings,
+		http2SettingsOrder: settings.Http2Settings.Order,
+		http2Fingerprint:   newHTTP2Fingerprint(settings),
+		pseudoHeaderOrder:  pseudoHeaderOrder(settings.Http2Settings.PseudoHeaderOrder),
+		timeouts:           p.cfg.timeouts,
+		pool:               p.cfg.pool,
+	})
+
+	if evicted, ok := p.roundTrippers.add(key, rt); ok {
+		go evicted.close()
+	}
+
+	return rt
+}
+
+// close closes the connections of every round tripper once they are idle.
+func (p *profileRoundTripper) close() {
+	p.mu.Lock()
+	roundTrippers := p.roundTrippers.values()
+	p.mu.Unlock()
+
+	for _, rt := range roundTrippers {
+		rt.close()
+	}
+}
+
+func redactProxy(proxyUrl string) string {
+	parsed, err := url.Parse(proxyUrl)
+
+	if err != nil {
+		return ""
+	}
+
+	return parsed.Redacted()
+}
@@ -0,0 +1,170 @@
+package http_client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	tls "github.com/vimbing/utls"
+)
+
+func TestHostTlsProfile(t *testing.T) {
+	okHttpProfile := TlsProfile{TransportSettings: TransportSettings{HelloID: tls.HelloAndroid_11_OkHttp}}
+	firefoxProfile := TlsProfile{TransportSettings: TransportSettings{HelloID: tls.HelloFirefox_120}}
+
+	resolver, _ := NewStaticResolver(map[string][]string{
+		"www.site.test":    {"127.0.0.1"},
+		"mobile.api.test":  {"127.0.0.1"},
+		"legacy.site.test": {"127.0.0.1"},
+	}, nil)
+
+	client := MustNew(
+		WithResolver(resolver),
+		WithTlsProfile(chrome140Profile()),
+		WithHostTlsProfile("*.api.test", okHttpProfile),
+		WithHostTlsProfileRegexp(`^legacy\.`, firefoxProfile),
+	)
+
+	expectedHello := func(helloID tls.ClientHelloID) []uint16 {
+		return captureClientHello(t, MustNew(WithTlsProfile(TlsProfile{TransportSettings: TransportSettings{HelloID: helloID}}))).extensions
+	}
+
+	testCases := []struct {
+		name        string
+		host        string
+		override    *TlsProfile
+		expectedIDs []uint16
+	}{
+		{name: "client profile", host: "www.site.test", expectedIDs: expectedHello(tls.HelloChrome_140)},
+		{name: "wildcard", host: "mobile.api.test", expectedIDs: expectedHello(tls.HelloAndroid_11_OkHttp)},
+		{name: "regexp", host: "legacy.site.test", expectedIDs: expectedHello(tls.HelloFirefox_120)},
+		{name: "request override", host: "mobile.api.test", override: &firefoxProfile, expectedIDs: expectedHello(tls.HelloFirefox_120)},
+	}
+
+	for _, testCase := range testCases {
+		hello := captureClientHelloFrom(t, func(addr string) {
+			_, port, _ := net.SplitHostPort(addr)
+
+			req, err := client.NewRequest(fmt.Sprintf("https://%s:%s/", testCase.host, port), "GET", nil, nil)
+
+			if err != nil {
+				return
+			}
+
+			if testCase.override != nil {
+				req.SetTlsProfile(*testCase.override)
+			}
+
+			client.Do(req)
+		})
+
+		// the expected hellos went to an IP address and carry no SNI
+		got := slices.DeleteFunc(withoutGREASE(hello.extensions), func(ext uint16) bool { return ext == 0 })
+
+		if !slices.Equal(got, withoutGREASE(testCase.expectedIDs)) {
+			t.Errorf("Unexpected ClientHello for %s, expected: %v got: %v", testCase.name, testCase.expectedIDs, hello.extensions)
+		}
+	}
+}
+
+func TestHostTlsProfileInvalidRegexp(t *testing.T) {
+	if _, err := New(WithHostTlsProfileRegexp(`(`, chrome140Profile())); err == nil {
+		t.Fatalf("Expected error for invalid host pattern")
+	}
+}
+
+func TestRequestTlsProfileSharesConnections(t *testing.T) {
+	client := MustNew(
+		WithInsecureSkipVerify(),
+		WithTlsProfile(chrome140Profile()),
+		WithoutTLSSessionResumption(),
+	)
+
+	url := fmt.Sprintf("https://127.0.0.1:%d/ping", testTLSServerPort)
+
+	profile := chrome140Profile()
+	profile.ID = "chrome"
+
+	for i := 0; i < 3; i++ {
+		req, _ := client.NewRequest(url, "GET", nil, nil)
+		req.SetTlsProfile(profile)
+
+		if _, err := client.Do(req); err != nil {
+			t.Fatalf("Unexpected error while getting test server: %v", err)
+		}
+	}
+
+	transport := client.snapshot().fhttpClient.Transport.(*profileRoundTripper)
+
+	if transport.roundTrippers.len() != 1 {
+		t.Errorf("Expected request profiles with one ID to share one transport, got: %d", transport.roundTrippers.len())
+	}
+
+	// without an ID every request gets its own, the oldest are dropped
+	for i := 0; i < maxProfileRoundTrippers+5; i++ {
+		req, _ := client.NewRequest(url, "GET", nil, nil)
+		req.SetTlsProfile(chrome140Profile())
+
+		if _, err := client.Do(req); err != nil {
+			t.Fatalf("Unexpected error while getting test server: %v", err)
+		}
+	}
+
+	if transport.roundTrippers.len() != maxProfileRoundTrippers {
+		t.Errorf("Unexpected number of transports: %d", transport.roundTrippers.len())
+	}
+}
+
+func TestDroppedTransportClosesBusyConnections(t *testing.T) {
+	release := make(chan struct{})
+	var inFlight, closed atomic.Int64
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			inFlight.Add(1)
+			<-release
+		}
+
+		w.Write([]byte(r.Proto))
+	}))
+
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed.Add(1)
+		}
+	}
+
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	client := MustNewClient(WithInsecureSkipVerify(), WithTlsProfile(chrome140Profile()))
+	done := make(chan error)
+
+	go func() {
+		_, err := client.R().URL(server.URL + "/block").TlsProfile(chrome140Profile()).Do(context.Background())
+		done <- err
+	}()
+
+	waitFor(t, func() bool { return inFlight.Load() == 1 })
+
+	// drops the transport of the blocked request while it is in flight
+	for i := 0; i < maxProfileRoundTrippers; i++ {
+		if _, err := client.R().URL(server.URL).TlsProfile(chrome140Profile()).Do(context.Background()); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error for the blocked request: %v", err)
+	}
+
+	waitFor(t, func() bool { return closed.Load() == 1 })
+}
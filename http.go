@@ -1,8 +1,10 @@
 package http_client
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"mime"
 	urlLib "net/url"
 	"strings"
 
@@ -35,52 +37,208 @@ func (c *Client) urlValues(v map[string]string) urlLib.Values {
 	return values
 }
 
-func (c *Client) NewRequest(url string, options ...any) (*Request, error) {
-	req := &Request{
-		Method: "GET",
+// encodeParams encodes params in their order, url.Values sorts them.
+func encodeParams(params []Param) string {
+	var b strings.Builder
+
+	for i, param := range params {
+		if i > 0 {
+			b.WriteByte('&')
+		}
+
+		b.WriteString(urlLib.QueryEscape(param.Key))
+		b.WriteByte('=')
+		b.WriteString(urlLib.QueryEscape(param.Value))
+	}
+
+	return b.String()
+}
+
+func appendQuery(url string, query string) string {
+	var joinChar = "?"
+
+	if strings.Contains(url, "?") {
+		joinChar = "&"
+	}
+
+	return fmt.Sprintf("%s%s%s", url, joinChar, query)
+}
+
+// RequestOption shapes a request, see Client.Request.
+type RequestOption interface {
+	requestOption()
+}
+
+func (OptionMethod) requestOption()          {}
+func (OptionHeader) requestOption()          {}
+func (OptionBody) requestOption()            {}
+func (OptionJSON) requestOption()            {}
+func (QueryParams) requestOption()           {}
+func (OrderedQueryParams) requestOption()    {}
+func (FormUrlEncoded) requestOption()        {}
+func (OrderedFormUrlEncoded) requestOption() {}
+func (MultipartForm) requestOption()         {}
+
+func WithMethod(method string) OptionMethod {
+	return OptionMethod(method)
+}
+
+// WithHeader replaces the headers of the request, header order keys
+// included.
+func WithHeader(header http.Header) OptionHeader {
+	return OptionHeader(header)
+}
+
+func WithBody(body io.Reader) OptionBody {
+	return OptionBody{body}
+}
+
+// WithJSON sends value encoded as JSON.
+func WithJSON(value any) OptionJSON {
+	return OptionJSON{value}
+}
+
+func newRequest(method, url string) *Request {
+	return &Request{
+		Method: method,
 		Url:    url,
 		Body:   nil,
 		Header: http.Header{},
 	}
+}
+
+// Request returns a request for method and url shaped by options, applied
+// in order.
+func (c *Client) Request(method, url string, options ...RequestOption) (*Request, error) {
+	req := newRequest(method, url)
 
 	for _, opt := range options {
-		switch v := opt.(type) {
-		case string:
-			req.Method = v
-		case http.Header:
-			req.Header = v
-		case io.Reader:
-			req.Body = v
-		case QueryParams:
-			values := c.urlValues(v)
-
-			var joinChar = "?"
-
-			if strings.Contains(req.Url, "?") {
-				joinChar = "&"
-			}
-
-			req.Url = fmt.Sprintf("%s%s%s", req.Url, joinChar, values.Encode())
-		case FormUrlEncoded:
-			req.Body = strings.NewReader(c.urlValues(v).Encode())
-
-			if len(req.Header.Get("content-type")) == 0 {
-				req.Header.Set("content-type", "application/x-www-form-urlencoded")
-			}
-		case RequestJsonBody:
-			body, err := marshalAndEncodeBody(v)
-
-			if err != nil {
-				return req, err
-			}
-
-			req.Body = body
+		if err := c.applyRequestOption(req, opt); err != nil {
+			return req, err
 		}
 	}
 
 	return req, nil
 }
 
+// Send does the request built by Request, retried as configured.
+func (c *Client) Send(method, url string, options ...RequestOption) (*Response, error) {
+	return c.SendContext(context.Background(), method, url, options...)
+}
+
+// SendContext is Send with a context, cancelling ctx aborts the request and
+// stops the retries, SendContext then returns the error of ctx.
+func (c *Client) SendContext(ctx context.Context, method, url string, options ...RequestOption) (*Response, error) {
+	req, err := c.Request(method, url, options...)
+
+	if err != nil {
+		return &Response{}, err
+	}
+
+	return c.snapshot().cfg.retry.retryContext(ctx, func(req *Request) (*Response, error) {
+		return c.doContext(ctx, req)
+	}, req)
+}
+
+// NewRequest returns a GET request for url shaped by options. Besides
+// RequestOption values it takes a string as method, an http.Header and an
+// io.Reader as body, a JSON body needs WithJSON. Anything else fails with
+// ErrUnknownOption.
+//
+// Deprecated: use Request, which checks the options at compile time.
+func (c *Client) NewRequest(url string, options ...any) (*Request, error) {
+	req := newRequest("GET", url)
+
+	for _, opt := range options {
+		option, err := requestOption(opt)
+
+		if err != nil {
+			return req, err
+		}
+
+		if option == nil {
+			continue
+		}
+
+		if err := c.applyRequestOption(req, option); err != nil {
+			return req, err
+		}
+	}
+
+	return req, nil
+}
+
+// requestOption converts a value passed to NewRequest, nil is skipped.
+func requestOption(opt any) (RequestOption, error) {
+	switch v := opt.(type) {
+	case nil:
+		return nil, nil
+	case RequestOption:
+		return v, nil
+	case ClientOption:
+		return nil, unknownOption(opt)
+	case string:
+		return OptionMethod(v), nil
+	case http.Header:
+		return OptionHeader(v), nil
+	case io.Reader:
+		return OptionBody{v}, nil
+	}
+
+	return nil, unknownOption(opt)
+}
+
+func (c *Client) applyRequestOption(req *Request, opt RequestOption) error {
+	switch v := opt.(type) {
+	case OptionMethod:
+		req.Method = string(v)
+	case OptionHeader:
+		req.Header = http.Header(v)
+	case OptionBody:
+		req.Body = v.Reader
+	case QueryParams:
+		req.Url = appendQuery(req.Url, c.urlValues(v).Encode())
+	case OrderedQueryParams:
+		req.Url = appendQuery(req.Url, encodeParams(v))
+	case FormUrlEncoded:
+		req.Body = strings.NewReader(c.urlValues(v).Encode())
+
+		if len(req.Header.Get("content-type")) == 0 {
+			req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		}
+	case OrderedFormUrlEncoded:
+		req.Body = strings.NewReader(encodeParams(v))
+
+		if len(req.Header.Get("content-type")) == 0 {
+			req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		}
+	case MultipartForm:
+		body, boundary, err := v.body()
+
+		if err != nil {
+			return err
+		}
+
+		req.Body = body
+
+		if len(req.Header.Get("content-type")) == 0 {
+			req.Header.Set("content-type", mime.FormatMediaType("multipart/form-data", map[string]string{"boundary": boundary}))
+		}
+	case OptionJSON:
+		body, err := marshalAndEncodeBody(v.value)
+
+		if err != nil {
+			return err
+		}
+
+		req.Body = body
+	default:
+		return unknownOption(opt)
+	}
+
+	return nil
+}
+
 func (c *Client) do(url string, options ...any) (*Response, error) {
 	req, err := c.NewRequest(url, options...)
 
@@ -88,25 +246,58 @@ func (c *Client) do(url string, options ...any) (*Response, error) {
 		return &Response{}, err
 	}
 
-	return c.cfg.retry.Retry(c.Do, req)
+	return c.snapshot().cfg.retry.Retry(c.Do, req)
 }
 
+// Get sends a GET request shaped by options, see NewRequest.
+//
+// Deprecated: use Send or R, which check the options at compile time.
 func (c *Client) Get(url string, options ...any) (*Response, error) {
 	options = append(options, "GET")
 	return c.do(url, options...)
 }
 
+// Post sends a POST request shaped by options, see NewRequest.
+//
+// Deprecated: use Send or R, which check the options at compile time.
 func (c *Client) Post(url string, options ...any) (*Response, error) {
 	options = append(options, "POST")
 	return c.do(url, options...)
 }
 
+// Put sends a PUT request shaped by options, see NewRequest.
+//
+// Deprecated: use Send or R, which check the options at compile time.
 func (c *Client) Put(url string, options ...any) (*Response, error) {
 	options = append(options, "PUT")
 	return c.do(url, options...)
 }
 
+// Delete sends a DELETE request shaped by options, see NewRequest.
+//
+// Deprecated: use Send or R, which check the options at compile time.
 func (c *Client) Delete(url string, options ...any) (*Response, error) {
 	options = append(options, "DELETE")
 	return c.do(url, options...)
 }
+
+// Patch sends a PATCH request.
+func (c *Client) Patch(url string, options ...RequestOption) (*Response, error) {
+	return c.Send("PATCH", url, options...)
+}
+
+// Head sends a HEAD request, the response has no body but its headers, see
+// Response.ContentLength.
+func (c *Client) Head(url string, options ...RequestOption) (*Response, error) {
+	return c.Send("HEAD", url, options...)
+}
+
+// Options sends an OPTIONS request, see Response.Allow.
+func (c *Client) Options(url string, options ...RequestOption) (*Response, error) {
+	return c.Send("OPTIONS", url, options...)
+}
+
+// Custom sends a request with any method, like PROPFIND.
+func (c *Client) Custom(method, url string, options ...RequestOption) (*Response, error) {
+	return c.Send(method, url, options...)
+}
@@ -0,0 +1,105 @@
+package http_client
+
+import (
+	"fmt"
+	"slices"
+
+	http "github.com/vimbing/fhttp"
+	"github.com/vimbing/fhttp/http2"
+)
+
+const (
+	// http2DefaultConnFlow is the connection WINDOW_UPDATE fhttp sends
+	// without a Flow.
+	http2DefaultConnFlow = 15663105
+
+	// http2InitialWindow is the connection window every peer starts with.
+	http2InitialWindow = 65535
+
+	// http2MaxConnFlow keeps the connection window within 2^31-1.
+	http2MaxConnFlow = 1<<31 - 1 - http2InitialWindow
+)
+
+var http2DefaultPseudoHeaderOrder = []string{":method", ":authority", ":scheme", ":path"}
+
+// http2Fingerprint holds the parts of the HTTP/2 fingerprint beyond the
+// SETTINGS, see apply.
+type http2Fingerprint struct {
+	flow             uint32
+	priorities       []Http2Priority
+	headerPriority   *http2.PriorityParam
+	noHeaderPriority bool
+}
+
+func newHTTP2Fingerprint(settings TransportSettings) http2Fingerprint {
+	return http2Fingerprint{
+		flow:             settings.Flow,
+		priorities:       settings.Http2Settings.Priorities,
+		headerPriority:   settings.Http2Settings.HeaderPriority,
+		noHeaderPriority: settings.Http2Settings.NoHeaderPriority,
+	}
+}
+
+// validateFlow rejects a Flow that would take the connection window beyond
+// what HTTP/2 allows.
+func validateFlow(settings TransportSettings) error {
+	if settings.Flow > http2MaxConnFlow {
+		return fmt.Errorf("%w: %d exceeds %d", ErrInvalidFlow, settings.Flow, http2MaxConnFlow)
+	}
+
+	return nil
+}
+
+// apply sets the fingerprint on the connections t2 opens.
+func (f http2Fingerprint) apply(t2 *http2.Transport) {
+	t2.ConnectionFlow = f.flow
+	t2.Priorities = f.priorities
+	t2.HeaderPriority = f.headerPriority
+	t2.NoHeaderPriority = f.noHeaderPriority
+}
+
+// pseudoHeaderOrder completes order with the pseudo headers it misses,
+// fhttp drops the ones not listed.
+func pseudoHeaderOrder(order []string) []string {
+	if len(order) == 0 {
+		return nil
+	}
+
+	completed := make([]string, 0, len(http2DefaultPseudoHeaderOrder))
+
+	for _, name := range order {
+		if slices.Contains(http2DefaultPseudoHeaderOrder, name) && !slices.Contains(completed, name) {
+			completed = append(completed, name)
+		}
+	}
+
+	for _, name := range http2DefaultPseudoHeaderOrder {
+		if !slices.Contains(completed, name) {
+			completed = append(completed, name)
+		}
+	}
+
+	return completed
+}
+
+// withPseudoHeaderOrder returns req carrying order unless it sets its own.
+func withPseudoHeaderOrder(req *http.Request, order []string) *http.Request {
+	if len(order) == 0 {
+		return req
+	}
+
+	if _, ok := req.Header[http.PHeaderOrderKey]; ok {
+		return req
+	}
+
+	ordered := *req
+	ordered.Header = req.Header.Clone()
+
+	if ordered.Header == nil {
+		ordered.Header = make(http.Header)
+	}
+
+	ordered.Header[http.PHeaderOrderKey] = order
+
+	return &ordered
+}
@@ -0,0 +1,254 @@
+package http_client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	fhttp "github.com/vimbing/fhttp"
+	fhttp2 "github.com/vimbing/fhttp/http2"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+type capturedHTTP2 struct {
+	flow           uint32
+	priorities     []Http2Priority
+	headerPriority *http2.PriorityParam
+	pseudoHeaders  []string
+}
+
+// captureHTTP2Frames points send at a TLS listener speaking h2 that records
+// the frames up to the first HEADERS and then hangs up.
+func captureHTTP2Frames(t *testing.T, send func(url string)) *capturedHTTP2 {
+	certPEM, keyPEM := generateClientCertificate(t, "127.0.0.1")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+
+	if err != nil {
+		t.Fatalf("Unexpected error while loading certificate: %v", err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2"},
+	})
+
+	if err != nil {
+		t.Fatalf("Unexpected error while starting listener: %v", err)
+	}
+
+	defer listener.Close()
+
+	capturedChan := make(chan *capturedHTTP2, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			capturedChan <- nil
+			return
+		}
+
+		defer conn.Close()
+
+		if _, err := io.ReadFull(conn, make([]byte, len(http2.ClientPreface))); err != nil {
+			capturedChan <- nil
+			return
+		}
+
+		framer := http2.NewFramer(conn, conn)
+		framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+
+		captured := &capturedHTTP2{}
+
+		for {
+			frame, err := framer.ReadFrame()
+
+			if err != nil {
+				capturedChan <- nil
+				return
+			}
+
+			switch frame := frame.(type) {
+			case *http2.WindowUpdateFrame:
+				if frame.StreamID == 0 && captured.flow == 0 {
+					captured.flow = frame.Increment
+				}
+			case *http2.PriorityFrame:
+				captured.priorities = append(captured.priorities, Http2Priority{
+					StreamID: frame.StreamID,
+					PriorityParam: fhttp2.PriorityParam{
+						StreamDep: frame.StreamDep,
+						Exclusive: frame.Exclusive,
+						Weight:    frame.Weight,
+					},
+				})
+			case *http2.MetaHeadersFrame:
+				if frame.HasPriority() {
+					captured.headerPriority = &frame.Priority
+				}
+
+				for _, field := range frame.PseudoFields() {
+					captured.pseudoHeaders = append(captured.pseudoHeaders, field.Name)
+				}
+
+				capturedChan <- captured
+				return
+			}
+		}
+	}()
+
+	go send(fmt.Sprintf("https://%s/", listener.Addr()))
+
+	captured := <-capturedChan
+
+	if captured == nil {
+		t.Fatalf("No HTTP/2 frames were captured")
+	}
+
+	return captured
+}
+
+func TestHTTP2Fingerprint(t *testing.T) {
+	firefox := chrome140Profile()
+	firefox.Flow = 12517377
+	firefox.Http2Settings.Priorities = []Http2Priority{
+		{StreamID: 3, PriorityParam: fhttp2.PriorityParam{Weight: 200}},
+		{StreamID: 5, PriorityParam: fhttp2.PriorityParam{Weight: 100}},
+		{StreamID: 7, PriorityParam: fhttp2.PriorityParam{Weight: 0}},
+		{StreamID: 9, PriorityParam: fhttp2.PriorityParam{StreamDep: 7, Weight: 0}},
+	}
+	firefox.Http2Settings.HeaderPriority = &fhttp2.PriorityParam{StreamDep: 9, Weight: 41}
+	firefox.Http2Settings.PseudoHeaderOrder = []string{":method", ":path", ":authority", ":scheme"}
+
+	safari := chrome140Profile()
+	safari.Flow = 10420225
+	safari.Http2Settings.NoHeaderPriority = true
+	safari.Http2Settings.PseudoHeaderOrder = []string{":method", ":scheme", ":path"}
+
+	testCases := []struct {
+		name     string
+		profile  TlsProfile
+		header   fhttp.Header
+		expected capturedHTTP2
+	}{
+		{
+			name:    "chrome",
+			profile: chrome140Profile(),
+			expected: capturedHTTP2{
+				flow:           15663105,
+				headerPriority: &http2.PriorityParam{Exclusive: true, Weight: 255},
+				pseudoHeaders:  []string{":authority", ":method", ":path", ":scheme"},
+			},
+		},
+		{
+			name:    "firefox",
+			profile: firefox,
+			expected: capturedHTTP2{
+				flow:           12517377,
+				priorities:     firefox.Http2Settings.Priorities,
+				headerPriority: &http2.PriorityParam{StreamDep: 9, Weight: 41},
+				pseudoHeaders:  []string{":method", ":path", ":authority", ":scheme"},
+			},
+		},
+		{
+			name:    "safari",
+			profile: safari,
+			expected: capturedHTTP2{
+				flow:          10420225,
+				pseudoHeaders: []string{":method", ":scheme", ":path", ":authority"},
+			},
+		},
+		{
+			name:    "request order",
+			profile: firefox,
+			header:  fhttp.Header{fhttp.PHeaderOrderKey: {":authority", ":method", ":path", ":scheme"}},
+			expected: capturedHTTP2{
+				flow:           12517377,
+				priorities:     firefox.Http2Settings.Priorities,
+				headerPriority: &http2.PriorityParam{StreamDep: 9, Weight: 41},
+				pseudoHeaders:  []string{":authority", ":method", ":path", ":scheme"},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		client := MustNew(WithInsecureSkipVerify(), WithTlsProfile(testCase.profile))
+
+		captured := captureHTTP2Frames(t, func(url string) {
+			client.Get(url, testCase.header)
+		})
+
+		if !reflect.DeepEqual(*captured, testCase.expected) {
+			t.Errorf("Unexpected frames for %s, expected: %+v got: %+v", testCase.name, testCase.expected, *captured)
+		}
+	}
+}
+
+func TestHTTP2FlowControl(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 24<<20)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	// windows below and beyond the body, which has to be read in pieces
+	for _, flow := range []uint32{1 << 20, http2DefaultConnFlow, 32 << 20} {
+		profile := chrome140Profile()
+		profile.Flow = flow
+
+		// fhttp only accounts for 4MB per stream whatever it advertises
+		profile.Http2Settings.Settings[fhttp2.SettingInitialWindowSize] = 4 << 20
+
+		res, err := MustNew(WithInsecureSkipVerify(), WithTlsProfile(profile)).Get(server.URL)
+
+		if err != nil {
+			t.Fatalf("Unexpected error for flow %d: %v", flow, err)
+		}
+
+		if len(res.Body) != len(body) || res.ConnInfo().NegotiatedProtocol != "h2" {
+			t.Errorf("Unexpected response for flow %d: %d bytes over %s", flow, len(res.Body), res.ConnInfo().NegotiatedProtocol)
+		}
+	}
+}
+
+func TestHTTP2FlowTooLarge(t *testing.T) {
+	profile := chrome140Profile()
+	profile.Flow = http2MaxConnFlow + 1
+
+	if _, err := New(WithTlsProfile(profile)); !errors.Is(err, ErrInvalidFlow) {
+		t.Errorf("Unexpected error for the client profile: %v", err)
+	}
+
+	if _, err := New(WithHostTlsProfile("example.com", profile)); !errors.Is(err, ErrInvalidFlow) {
+		t.Errorf("Unexpected error for the host profile: %v", err)
+	}
+
+	_, err := MustNew().R().URL("https://127.0.0.1:1/").TlsProfile(profile).Do(context.Background())
+
+	if !errors.Is(err, ErrInvalidFlow) {
+		t.Errorf("Unexpected error for the request profile: %v", err)
+	}
+}
+
+func TestPseudoHeaderOrder(t *testing.T) {
+	if order := pseudoHeaderOrder([]string{":path", ":bogus", ":path", ":method"}); strings.Join(order, ",") != ":path,:method,:authority,:scheme" {
+		t.Errorf("Unexpected order: %v", order)
+	}
+
+	if order := pseudoHeaderOrder(nil); order != nil {
+		t.Errorf("Unexpected order: %v", order)
+	}
+}
@@ -0,0 +1,193 @@
+package http_client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	fhttp "github.com/vimbing/fhttp"
+)
+
+func TestRequestParams(t *testing.T) {
+	client := MustNew()
+
+	testCases := []struct {
+		name        string
+		url         string
+		options     []any
+		expectedUrl string
+		body        string
+	}{
+		{
+			name:        "query map",
+			url:         "http://127.0.0.1/search",
+			options:     []any{QueryParams{"b": "2", "a": "1"}},
+			expectedUrl: "http://127.0.0.1/search?a=1&b=2",
+		},
+		{
+			name:        "ordered query",
+			url:         "http://127.0.0.1/search?page=1",
+			options:     []any{OrderedQueryParams{{"id", "2"}, {"q", "a b&c"}, {"id", "1"}}},
+			expectedUrl: "http://127.0.0.1/search?page=1&id=2&q=a+b%26c&id=1",
+		},
+		{
+			name:        "form map",
+			url:         "http://127.0.0.1/login",
+			options:     []any{FormUrlEncoded{"user": "jane", "pass": "x"}},
+			expectedUrl: "http://127.0.0.1/login",
+			body:        "pass=x&user=jane",
+		},
+		{
+			name:        "ordered form",
+			url:         "http://127.0.0.1/login",
+			options:     []any{OrderedFormUrlEncoded{{"user", "jane"}, {"tag", "a"}, {"tag", "b=c"}}},
+			expectedUrl: "http://127.0.0.1/login",
+			body:        "user=jane&tag=a&tag=b%3Dc",
+		},
+	}
+
+	for _, testCase := range testCases {
+		req, err := client.NewRequest(testCase.url, testCase.options...)
+
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", testCase.name, err)
+		}
+
+		if req.Url != testCase.expectedUrl {
+			t.Errorf("Unexpected url for %s, expected %s got %s", testCase.name, testCase.expectedUrl, req.Url)
+		}
+
+		if testCase.body == "" {
+			continue
+		}
+
+		body, _ := io.ReadAll(req.Body)
+
+		if string(body) != testCase.body {
+			t.Errorf("Unexpected body for %s, expected %s got %s", testCase.name, testCase.body, body)
+		}
+
+		if req.Header.Get("content-type") != "application/x-www-form-urlencoded" {
+			t.Errorf("Unexpected content type for %s: %s", testCase.name, req.Header.Get("content-type"))
+		}
+	}
+}
+
+func TestTypedRequestOptions(t *testing.T) {
+	client := MustNewClient(WithTlsProfile(chrome140Profile()))
+
+	res, err := client.Send(
+		"POST",
+		fmt.Sprintf("http://127.0.0.1:%d/json", testServerPort),
+		WithHeader(fhttp.Header{"X-Test": {"1"}}),
+		OrderedQueryParams{{"a", "1"}},
+		WithJSON(map[string]int{"count": 1}),
+	)
+
+	if err != nil {
+		t.Fatalf("Unexpected error while sending request: %v", err)
+	}
+
+	if res.BodyString() != `{"count":1}` {
+		t.Errorf("Unexpected body: %s", res.BodyString())
+	}
+
+	req, err := client.Request("PROPFIND", "http://127.0.0.1/", WithBody(strings.NewReader("raw")))
+
+	if err != nil || req.Method != "PROPFIND" {
+		t.Fatalf("Unexpected request %s: %v", req.Method, err)
+	}
+
+	if body, _ := io.ReadAll(req.Body); string(body) != "raw" {
+		t.Errorf("Unexpected body: %s", body)
+	}
+}
+
+func TestNewRequestUnknownOptions(t *testing.T) {
+	client := MustNew()
+
+	for _, option := range []any{42, true, []int{1, 2}, map[string]any{}, WithInsecureSkipVerify(), WithProxy("127.0.0.1:8080")} {
+		if _, err := client.NewRequest("http://127.0.0.1/", option); !errors.Is(err, ErrUnknownOption) {
+			t.Errorf("Unexpected error for %T: %v", option, err)
+		}
+	}
+
+	req, err := client.NewRequest("http://127.0.0.1/", "POST", nil, WithJSON([]int{1, 2}), fhttp.Header{"X-Test": {"1"}})
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if body, _ := io.ReadAll(req.Body); req.Method != "POST" || string(body) != "[1,2]" || req.Header.Get("x-test") != "1" {
+		t.Errorf("Unexpected request %s with body %s", req.Method, body)
+	}
+}
+
+func TestVerbsAndBodilessResponses(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "HEAD":
+			// a gzip encoded body that HEAD leaves out
+			w.Header().Set("content-encoding", "gzip")
+			w.Header().Set("content-length", "1234")
+		case "OPTIONS":
+			w.Header().Add("allow", "GET, HEAD,")
+			w.Header().Add("allow", "PROPFIND")
+			w.Header().Set("content-encoding", "gzip")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Write([]byte(r.Method))
+		}
+	})
+
+	h1 := httptest.NewServer(handler)
+	defer h1.Close()
+
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	client := MustNew(WithInsecureSkipVerify(), WithTlsProfile(chrome140Profile()))
+
+	for _, url := range []string{h1.URL, h2.URL} {
+		res, err := client.Head(url)
+
+		if err != nil {
+			t.Fatalf("Unexpected error for HEAD %s: %v", url, err)
+		}
+
+		if len(res.Body) != 0 || res.ContentLength() != 1234 {
+			t.Errorf("Unexpected HEAD response from %s: %d bytes, length %d", url, len(res.Body), res.ContentLength())
+		}
+
+		res, err = client.Options(url)
+
+		if err != nil {
+			t.Fatalf("Unexpected error for OPTIONS %s: %v", url, err)
+		}
+
+		if allow := res.Allow(); res.StatusCode() != http.StatusNoContent || strings.Join(allow, ",") != "GET,HEAD,PROPFIND" {
+			t.Errorf("Unexpected OPTIONS response from %s: %s %v", url, res.Status(), allow)
+		}
+
+		for method, send := range map[string]func() (*Response, error){
+			"PATCH":    func() (*Response, error) { return client.Patch(url, WithJSON([]int{1})) },
+			"PROPFIND": func() (*Response, error) { return client.Custom("PROPFIND", url) },
+		} {
+			res, err := send()
+
+			if err != nil {
+				t.Fatalf("Unexpected error for %s %s: %v", method, url, err)
+			}
+
+			if res.BodyString() != method || res.ContentLength() != int64(len(method)) {
+				t.Errorf("Unexpected %s response from %s: %s", method, url, res.BodyString())
+			}
+		}
+	}
+}
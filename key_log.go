@@ -0,0 +1,57 @@
+package http_client
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// keyLogEnv names the file TLS secrets are appended to in NSS key log
+// format, the same variable browsers and curl read.
+const keyLogEnv = "SSLKEYLOGFILE"
+
+// lockedWriter serializes writes, key log lines come from every connection
+// of a client, or of every client for SSLKEYLOGFILE, at once.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.w.Write(p)
+}
+
+// keyLogFile is the writer of the file named by SSLKEYLOGFILE, shared by
+// every client of the process.
+var keyLogFile struct {
+	once sync.Once
+	w    io.Writer
+	err  error
+}
+
+// openKeyLogFile opens the file named by SSLKEYLOGFILE for appending on the
+// first call and returns the same writer afterwards, it is nil when the
+// variable is not set.
+func openKeyLogFile() (io.Writer, error) {
+	keyLogFile.once.Do(func() {
+		path := os.Getenv(keyLogEnv)
+
+		if len(path) == 0 {
+			return
+		}
+
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+
+		if err != nil {
+			keyLogFile.err = err
+			return
+		}
+
+		keyLogFile.w = &lockedWriter{w: file}
+	})
+
+	return keyLogFile.w, keyLogFile.err
+}
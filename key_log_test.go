@@ -0,0 +1,65 @@
+package http_client
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeyLogWriter(t *testing.T) {
+	var keyLog bytes.Buffer
+
+	client := MustNew(
+		WithKeyLogWriter(&keyLog),
+		WithInsecureSkipVerify(),
+		WithTlsProfile(chrome140Profile()),
+	)
+
+	if _, err := client.Get(fmt.Sprintf("https://127.0.0.1:%d/ping", testTLSServerPort)); err != nil {
+		t.Fatalf("Unexpected error while getting test server: %v", err)
+	}
+
+	if !strings.Contains(keyLog.String(), "CLIENT_TRAFFIC_SECRET_0 ") {
+		t.Fatalf("Expected traffic secret in key log, got: %q", keyLog.String())
+	}
+}
+
+func TestKeyLogFromEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.log")
+	t.Setenv(keyLogEnv, path)
+
+	testCases := []struct {
+		name        string
+		options     []any
+		expectedLog bool
+	}{
+		{name: "not enabled", options: []any{}, expectedLog: false},
+		{name: "enabled", options: []any{WithKeyLogFromEnv()}, expectedLog: true},
+	}
+
+	for _, testCase := range testCases {
+		os.Remove(path)
+
+		client := MustNew(
+			append(testCase.options, WithInsecureSkipVerify(), WithTlsProfile(chrome140Profile()))...,
+		)
+
+		if _, err := client.Get(fmt.Sprintf("https://127.0.0.1:%d/ping", testTLSServerPort)); err != nil {
+			t.Fatalf("Unexpected error for %s while getting test server: %v", testCase.name, err)
+		}
+
+		keyLog, _ := os.ReadFile(path)
+
+		if bytes.Contains(keyLog, []byte("CLIENT_TRAFFIC_SECRET_0 ")) != testCase.expectedLog {
+			t.Errorf("Unexpected key log for %s, expected log: %t got: %q", testCase.name, testCase.expectedLog, keyLog)
+		}
+	}
+
+	// the file is opened once and shared by every client
+	if first, second := MustNew(WithKeyLogFromEnv()), MustNew(WithKeyLogFromEnv()); first.cfg.keyLogWriter != second.cfg.keyLogWriter {
+		t.Errorf("Clients opened the key log file separately")
+	}
+}
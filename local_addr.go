@@ -0,0 +1,81 @@
+package http_client
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// IPFamily restricts which address family outgoing connections use.
+type IPFamily int
+
+const (
+	// IPFamilyAuto races IPv6 and IPv4 addresses (happy eyeballs).
+	IPFamilyAuto IPFamily = iota
+	IPFamilyIPv4
+	IPFamilyIPv6
+)
+
+func (f IPFamily) allows(ip net.IP) bool {
+	switch f {
+	case IPFamilyIPv4:
+		return ip.To4() != nil
+	case IPFamilyIPv6:
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// LocalAddrPool hands out source addresses for outgoing connections in
+// round-robin order. A pool can be shared between clients.
+type LocalAddrPool struct {
+	ipv4 []net.IP
+	ipv6 []net.IP
+	next atomic.Uint64
+
+	// err is why WithLocalAddr couldn't build the pool, New reports it
+	err error
+}
+
+func NewLocalAddrPool(addrs ...string) (*LocalAddrPool, error) {
+	pool := &LocalAddrPool{}
+
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+
+		if ip == nil {
+			return nil, fmt.Errorf("invalid local address %q", addr)
+		}
+
+		if ip.To4() != nil {
+			pool.ipv4 = append(pool.ipv4, ip)
+		} else {
+			pool.ipv6 = append(pool.ipv6, ip)
+		}
+	}
+
+	return pool, nil
+}
+
+// pick returns the next local address of the same family as remote, ok is
+// false when the pool has none of that family.
+func (p *LocalAddrPool) pick(remote net.IP) (addr *net.TCPAddr, ok bool) {
+	if p == nil {
+		return nil, true
+	}
+
+	candidates := p.ipv6
+
+	if remote.To4() != nil {
+		candidates = p.ipv4
+	}
+
+	if len(candidates) == 0 {
+		return nil, false
+	}
+
+	ip := candidates[(p.next.Add(1)-1)%uint64(len(candidates))]
+
+	return &net.TCPAddr{IP: ip}, true
+}
@@ -0,0 +1,106 @@
+package http_client
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLocalAddrBinding(t *testing.T) {
+	client := MustNew(
+		WithLocalAddr("127.0.0.2"),
+	)
+
+	res, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/remote-addr", testServerPort))
+
+	if err != nil {
+		t.Fatalf("Unexpected error while getting remote address: %v", err)
+	}
+
+	if res.BodyString() != "127.0.0.2" {
+		t.Errorf("Unexpected source address, expected: 127.0.0.2 got: %s", res.BodyString())
+	}
+}
+
+func TestLocalAddrPoolRotation(t *testing.T) {
+	pool, err := NewLocalAddrPool("127.0.0.2", "127.0.0.3")
+
+	if err != nil {
+		t.Fatalf("Unexpected error while creating pool: %v", err)
+	}
+
+	client := MustNew(
+		WithLocalAddrPool(pool),
+	)
+
+	seen := map[string]int{}
+
+	for i := 0; i < 4; i++ {
+		// fresh transport every time, so each request opens a connection
+		client.RotateProxy()
+
+		res, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/remote-addr", testServerPort))
+
+		if err != nil {
+			t.Fatalf("Unexpected error while getting remote address: %v", err)
+		}
+
+		seen[res.BodyString()]++
+	}
+
+	if seen["127.0.0.2"] != 2 || seen["127.0.0.3"] != 2 {
+		t.Errorf("Source addresses were not rotated evenly: %v", seen)
+	}
+
+	if _, err := NewLocalAddrPool("not-an-ip"); err == nil {
+		t.Errorf("Expected error for invalid local address")
+	}
+
+	for _, addrs := range [][]string{{"127.0.0.2", "not-an-ip"}, {}} {
+		if _, err := New(WithLocalAddr(addrs...)); err == nil {
+			t.Errorf("Expected error for local addresses %v", addrs)
+		}
+	}
+}
+
+func TestIPFamily(t *testing.T) {
+	// the test server only listens on IPv4, so ::1 always refuses
+	resolver, err := NewStaticResolver(map[string][]string{
+		"dual.test": {"::1", "127.0.0.1"},
+	}, nil)
+
+	if err != nil {
+		t.Fatalf("Unexpected error while creating resolver: %v", err)
+	}
+
+	testCases := []struct {
+		family      IPFamily
+		shouldError bool
+	}{
+		{family: IPFamilyAuto, shouldError: false},
+		{family: IPFamilyIPv4, shouldError: false},
+		{family: IPFamilyIPv6, shouldError: true},
+	}
+
+	for _, testCase := range testCases {
+		client := MustNew(
+			WithResolver(resolver),
+			WithIPFamily(testCase.family),
+		)
+
+		_, err := client.Get(fmt.Sprintf("http://dual.test:%d/ping", testServerPort))
+
+		if testCase.shouldError != (err != nil) {
+			t.Errorf("Unexpected result for family %d: %v", testCase.family, err)
+		}
+	}
+}
+
+func TestLocalAddrFamilyMismatch(t *testing.T) {
+	client := MustNew(
+		WithLocalAddr("::1"),
+	)
+
+	if _, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/ping", testServerPort)); err == nil {
+		t.Errorf("Expected error when no local address matches the remote family")
+	}
+}
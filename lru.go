@@ -0,0 +1,74 @@
+package http_client
+
+import "container/list"
+
+// lruCache keeps up to size values, adding one more evicts the least
+// recently used. Callers synchronize access.
+type lruCache[K comparable, V any] struct {
+	size    int
+	order   *list.List
+	entries map[K]*list.Element
+}
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+func newLRUCache[K comparable, V any](size int) *lruCache[K, V] {
+	return &lruCache[K, V]{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[K]*list.Element),
+	}
+}
+
+func (c *lruCache[K, V]) get(key K) (V, bool) {
+	element, ok := c.entries[key]
+
+	if !ok {
+		var zero V
+		return zero, false
+	}
+
+	c.order.MoveToFront(element)
+
+	return element.Value.(*lruEntry[K, V]).value, true
+}
+
+// add stores value under key and returns the value it evicted to make room,
+// ok reports whether there was one.
+func (c *lruCache[K, V]) add(key K, value V) (evicted V, ok bool) {
+	if element, exists := c.entries[key]; exists {
+		element.Value.(*lruEntry[K, V]).value = value
+		c.order.MoveToFront(element)
+
+		return evicted, false
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry[K, V]{key: key, value: value})
+
+	if c.order.Len() <= c.size {
+		return evicted, false
+	}
+
+	oldest := c.order.Remove(c.order.Back()).(*lruEntry[K, V])
+	delete(c.entries, oldest.key)
+
+	return oldest.value, true
+}
+
+func (c *lruCache[K, V]) len() int {
+	return c.order.Len()
+}
+
+// values returns the values from the most to the least recently used.
+func (c *lruCache[K, V]) values() []V {
+	values := make([]V, 0, c.order.Len())
+
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		values = append(values, element.Value.(*lruEntry[K, V]).value)
+	}
+
+	return values
+}
@@ -0,0 +1,411 @@
+package http_client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	fhttp "github.com/vimbing/fhttp"
+)
+
+// MultipartForm is a multipart/form-data request body. Parts are sent in
+// order and streamed, files are only opened and read while the request is
+// written. Retries and redirects send the form again, reopening the files
+// and seeking the readers back to where they started.
+type MultipartForm struct {
+	Parts []MultipartPart
+
+	// Boundary separates the parts, empty generates one the way Chrome
+	// does, see WebKitBoundary.
+	Boundary string
+}
+
+// MultipartPart is a field of a MultipartForm. Its content is the first of
+// Path, Reader, Bytes and Value that is set.
+type MultipartPart struct {
+	Name string
+
+	// FileName makes the part a file upload, it defaults to the base name
+	// of Path.
+	FileName string
+
+	// ContentType defaults to the type of the FileName extension for files
+	// and is left out for other fields.
+	ContentType string
+
+	// Header holds additional headers of the part.
+	Header fhttp.Header
+
+	Value  string
+	Bytes  []byte
+	Reader io.Reader
+	Path   string
+}
+
+// MultipartField returns a plain form field.
+func MultipartField(name, value string) MultipartPart {
+	return MultipartPart{Name: name, Value: value}
+}
+
+// MultipartFile returns a part uploading the file at path.
+func MultipartFile(name, path string) MultipartPart {
+	return MultipartPart{Name: name, Path: path}
+}
+
+// MultipartReader returns a part uploading what is read from reader as
+// fileName. Unless reader is a bytes or strings reader its size is unknown
+// and the request is sent chunked. Sending the form again fails with
+// ErrMultipartReplay unless reader is an io.Seeker.
+func MultipartReader(name, fileName string, reader io.Reader) MultipartPart {
+	return MultipartPart{Name: name, FileName: fileName, Reader: reader}
+}
+
+// MultipartBytes returns a part uploading data as fileName.
+func MultipartBytes(name, fileName string, data []byte) MultipartPart {
+	return MultipartPart{Name: name, FileName: fileName, Bytes: data}
+}
+
+const webKitBoundaryAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// WebKitBoundary returns a boundary formatted like the ones of Chrome and
+// Safari, ----WebKitFormBoundary followed by 16 random alphanumerics.
+func WebKitBoundary() string {
+	random := make([]byte, 16)
+	_, _ = rand.Read(random)
+
+	for i, b := range random {
+		random[i] = webKitBoundaryAlphabet[int(b)%len(webKitBoundaryAlphabet)]
+	}
+
+	return "----WebKitFormBoundary" + string(random)
+}
+
+// ErrMultipartBoundary is returned for a boundary RFC 2046 doesn't allow.
+var ErrMultipartBoundary = errors.New("invalid multipart boundary")
+
+// ErrMultipartReplay is returned when a form is sent again, for a retry or
+// a redirect, and one of its readers can't seek back to where it started.
+var ErrMultipartReplay = errors.New("multipart reader can't be read again")
+
+// multipartBody streams a MultipartForm. Its length is -1 when a part
+// reads from a reader of unknown size. reopen returns a fresh body for
+// sending the form again.
+type multipartBody struct {
+	io.Reader
+	length int64
+	files  []*lazyFile
+
+	boundary string
+	headers  []string
+	contents []multipartContent
+
+	// sent is set once the body was handed to a request
+	sent bool
+}
+
+// multipartContent is the source of a part, opened again for every body.
+type multipartContent struct {
+	// size is -1 when unknown
+	size int64
+
+	// the content is read from the file at path, from reader or from data
+	path   string
+	reader io.Reader
+	data   []byte
+
+	// offset is where a seekable reader started, it is rewound there
+	seeker io.Seeker
+	offset int64
+}
+
+// Close closes the files left open when the request didn't send them all.
+func (b *multipartBody) Close() error {
+	var errs []error
+
+	for _, file := range b.files {
+		errs = append(errs, file.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+func (form MultipartForm) body() (*multipartBody, string, error) {
+	boundary := form.Boundary
+
+	if boundary == "" {
+		boundary = WebKitBoundary()
+	}
+
+	if !validBoundary(boundary) {
+		return nil, "", fmt.Errorf("%w: %q", ErrMultipartBoundary, boundary)
+	}
+
+	body := &multipartBody{
+		boundary: boundary,
+		headers:  make([]string, 0, len(form.Parts)),
+		contents: make([]multipartContent, 0, len(form.Parts)),
+	}
+
+	sized := true
+
+	for _, part := range form.Parts {
+		content, err := part.content()
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		header := "--" + boundary + "\r\n" + part.header() + "\r\n"
+
+		body.headers = append(body.headers, header)
+		body.contents = append(body.contents, content)
+		body.length += int64(len(header)+len("\r\n")) + content.size
+
+		sized = sized && content.size >= 0
+	}
+
+	body.length += int64(len("--" + boundary + "--\r\n"))
+
+	if !sized {
+		body.length = -1
+	}
+
+	body.Reader = body.readers()
+
+	return body, boundary, nil
+}
+
+// reopen returns a body sending the form again from the start, the files
+// are opened anew and the readers rewound.
+func (b *multipartBody) reopen() (*multipartBody, error) {
+	for _, content := range b.contents {
+		if content.reader == nil {
+			continue
+		}
+
+		if content.seeker == nil {
+			return nil, ErrMultipartReplay
+		}
+
+		if _, err := content.seeker.Seek(content.offset, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrMultipartReplay, err)
+		}
+	}
+
+	body := &multipartBody{
+		length:   b.length,
+		boundary: b.boundary,
+		headers:  b.headers,
+		contents: b.contents,
+	}
+
+	body.Reader = body.readers()
+
+	return body, nil
+}
+
+// readers returns the reader of the whole body, files are added to b.files.
+func (b *multipartBody) readers() io.Reader {
+	readers := make([]io.Reader, 0, 3*len(b.contents)+1)
+
+	for i, content := range b.contents {
+		var reader io.Reader
+
+		switch {
+		case content.path != "":
+			file := &lazyFile{path: content.path}
+			b.files = append(b.files, file)
+			reader = file
+		case content.reader != nil:
+			reader = content.reader
+		default:
+			reader = bytes.NewReader(content.data)
+		}
+
+		readers = append(readers, strings.NewReader(b.headers[i]), reader, strings.NewReader("\r\n"))
+	}
+
+	return io.MultiReader(append(readers, strings.NewReader("--"+b.boundary+"--\r\n"))...)
+}
+
+// content returns the source of the part content. Files are checked right
+// away but opened when first read.
+func (part MultipartPart) content() (multipartContent, error) {
+	switch {
+	case part.Path != "":
+		info, err := os.Stat(part.Path)
+
+		if err != nil {
+			return multipartContent{}, err
+		}
+
+		return multipartContent{size: info.Size(), path: part.Path}, nil
+	case part.Reader != nil:
+		content := multipartContent{size: -1, reader: part.Reader}
+
+		switch reader := part.Reader.(type) {
+		case *bytes.Reader:
+			content.size = int64(reader.Len())
+		case *bytes.Buffer:
+			// read from a copy so the buffer is left for a replay
+			content.reader = bytes.NewReader(reader.Bytes())
+			content.size = int64(reader.Len())
+		case *strings.Reader:
+			content.size = int64(reader.Len())
+		}
+
+		if seeker, ok := content.reader.(io.Seeker); ok {
+			offset, err := seeker.Seek(0, io.SeekCurrent)
+
+			if err == nil {
+				content.seeker = seeker
+				content.offset = offset
+			}
+		}
+
+		return content, nil
+	case part.Bytes != nil:
+		return multipartContent{size: int64(len(part.Bytes)), data: part.Bytes}, nil
+	}
+
+	return multipartContent{size: int64(len(part.Value)), data: []byte(part.Value)}, nil
+}
+
+// header returns the headers of the part, Content-Disposition and
+// Content-Type first as browsers send them.
+func (part MultipartPart) header() string {
+	var b strings.Builder
+
+	b.WriteString(`Content-Disposition: form-data; name="` + escapeMultipartName(part.Name) + `"`)
+
+	fileName := part.FileName
+
+	if fileName == "" && part.Path != "" {
+		fileName = filepath.Base(part.Path)
+	}
+
+	contentType := part.ContentType
+
+	if fileName != "" || part.Path != "" {
+		b.WriteString(`; filename="` + escapeMultipartName(fileName) + `"`)
+
+		if contentType == "" {
+			contentType = fileContentType(fileName)
+		}
+	}
+
+	b.WriteString("\r\n")
+
+	if contentType != "" {
+		b.WriteString("Content-Type: " + contentType + "\r\n")
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(part.Header)) {
+		if strings.EqualFold(key, "content-disposition") || strings.EqualFold(key, "content-type") {
+			continue
+		}
+
+		for _, value := range part.Header[key] {
+			b.WriteString(key + ": " + value + "\r\n")
+		}
+	}
+
+	return b.String()
+}
+
+// escapeMultipartName escapes a field or file name the way browsers do.
+func escapeMultipartName(name string) string {
+	return strings.NewReplacer("\n", "%0A", "\r", "%0D", `"`, "%22").Replace(name)
+}
+
+// fileContentType returns the type browsers send for a file named name,
+// without the parameters Go adds to some types.
+func fileContentType(name string) string {
+	contentType, _, _ := strings.Cut(mime.TypeByExtension(filepath.Ext(name)), ";")
+
+	if contentType == "" {
+		return "application/octet-stream"
+	}
+
+	return contentType
+}
+
+func validBoundary(boundary string) bool {
+	if len(boundary) < 1 || len(boundary) > 70 || strings.HasSuffix(boundary, " ") {
+		return false
+	}
+
+	for _, r := range boundary {
+		switch {
+		case 'A' <= r && r <= 'Z', 'a' <= r && r <= 'z', '0' <= r && r <= '9':
+		case strings.ContainsRune("'()+_,-./:=? ", r):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// lazyFile opens the file at path on the first read and closes it at its
+// end. fhttp may close the body while another goroutine writes it.
+type lazyFile struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	closed bool
+}
+
+func (f *lazyFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, io.EOF
+	}
+
+	if f.file == nil {
+		file, err := os.Open(f.path)
+
+		if err != nil {
+			return 0, err
+		}
+
+		f.file = file
+	}
+
+	n, err := f.file.Read(p)
+
+	if err == io.EOF {
+		_ = f.close()
+	}
+
+	return n, err
+}
+
+func (f *lazyFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.close()
+}
+
+func (f *lazyFile) close() error {
+	if f.closed || f.file == nil {
+		f.closed = true
+		return nil
+	}
+
+	f.closed = true
+
+	return f.file.Close()
+}
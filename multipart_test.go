@@ -0,0 +1,267 @@
+package http_client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	fhttp "github.com/vimbing/fhttp"
+)
+
+type receivedPart struct {
+	Name        string
+	FileName    string
+	ContentType string
+	Extra       string
+	Content     string
+}
+
+type receivedMultipart struct {
+	ContentType      string
+	ContentLength    int64
+	TransferEncoding []string
+	Parts            []receivedPart
+}
+
+// startMultipartServer returns a server answering with the multipart form
+// it received as JSON.
+func startMultipartServer(t *testing.T) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received := receivedMultipart{
+			ContentType:      r.Header.Get("content-type"),
+			ContentLength:    r.ContentLength,
+			TransferEncoding: r.TransferEncoding,
+		}
+
+		reader, err := r.MultipartReader()
+
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		for {
+			part, err := reader.NextRawPart()
+
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			content, _ := io.ReadAll(part)
+
+			received.Parts = append(received.Parts, receivedPart{
+				Name:        part.FormName(),
+				FileName:    part.FileName(),
+				ContentType: part.Header.Get("content-type"),
+				Extra:       part.Header.Get("x-extra"),
+				Content:     string(content),
+			})
+		}
+
+		json.NewEncoder(w).Encode(received)
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server.URL
+}
+
+func TestMultipartForm(t *testing.T) {
+	url := startMultipartServer(t)
+	path := filepath.Join(t.TempDir(), "avatar.png")
+
+	if err := os.WriteFile(path, []byte("not really a png"), 0o600); err != nil {
+		t.Fatalf("Unexpected error while writing file: %v", err)
+	}
+
+	data := MultipartBytes("data", "data.bin", []byte{0, 1, 2})
+	data.ContentType = "application/x-custom"
+	data.Header = fhttp.Header{"X-Extra": {"yes"}}
+
+	form := MultipartForm{Parts: []MultipartPart{
+		MultipartField("user", "jane"),
+		MultipartField(`quoted "name"`, "value"),
+		MultipartFile("avatar", path),
+		data,
+		MultipartReader("notes", "notes.txt", strings.NewReader("some notes")),
+	}}
+
+	res, err := MustNew().Post(url, form)
+
+	if err != nil {
+		t.Fatalf("Unexpected error while posting form: %v", err)
+	}
+
+	var received receivedMultipart
+
+	if err := json.Unmarshal(res.Body, &received); err != nil {
+		t.Fatalf("Unexpected response %s: %v", res.BodyString(), err)
+	}
+
+	if !strings.HasPrefix(received.ContentType, "multipart/form-data; boundary=----WebKitFormBoundary") {
+		t.Errorf("Unexpected content type: %s", received.ContentType)
+	}
+
+	if received.ContentLength <= 0 || len(received.TransferEncoding) != 0 {
+		t.Errorf("Unexpected framing, length %d encoding %v", received.ContentLength, received.TransferEncoding)
+	}
+
+	expected := []receivedPart{
+		{Name: "user", Content: "jane"},
+		{Name: `quoted %22name%22`, Content: "value"},
+		{Name: "avatar", FileName: "avatar.png", ContentType: "image/png", Content: "not really a png"},
+		{Name: "data", FileName: "data.bin", ContentType: "application/x-custom", Extra: "yes", Content: "\x00\x01\x02"},
+		{Name: "notes", FileName: "notes.txt", ContentType: "text/plain", Content: "some notes"},
+	}
+
+	if !reflect.DeepEqual(received.Parts, expected) {
+		t.Errorf("Unexpected parts, expected: %+v got: %+v", expected, received.Parts)
+	}
+}
+
+func TestMultipartFormUnknownSize(t *testing.T) {
+	url := startMultipartServer(t)
+	content := bytes.Repeat([]byte("x"), 1<<20)
+
+	// hides the size of the bytes.Reader
+	reader := struct{ io.Reader }{bytes.NewReader(content)}
+
+	form := MultipartForm{
+		Parts:    []MultipartPart{MultipartReader("file", "big.bin", reader)},
+		Boundary: "custom-boundary",
+	}
+
+	res, err := MustNew().Post(url, form)
+
+	if err != nil {
+		t.Fatalf("Unexpected error while posting form: %v", err)
+	}
+
+	var received receivedMultipart
+
+	if err := json.Unmarshal(res.Body, &received); err != nil {
+		t.Fatalf("Unexpected response %s: %v", res.BodyString(), err)
+	}
+
+	if received.ContentType != "multipart/form-data; boundary=custom-boundary" {
+		t.Errorf("Unexpected content type: %s", received.ContentType)
+	}
+
+	if received.ContentLength != -1 || !reflect.DeepEqual(received.TransferEncoding, []string{"chunked"}) {
+		t.Errorf("Unexpected framing, length %d encoding %v", received.ContentLength, received.TransferEncoding)
+	}
+
+	if len(received.Parts) != 1 || received.Parts[0].Content != string(content) {
+		t.Errorf("Unexpected parts: %d", len(received.Parts))
+	}
+}
+
+func TestMultipartFormReplay(t *testing.T) {
+	url := startMultipartServer(t)
+	var attempts atomic.Int64
+
+	// the first attempt fails after reading the form, then the form is
+	// redirected to the multipart server
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+
+		if attempts.Add(1) == 1 {
+			panic(http.ErrAbortHandler)
+		}
+
+		http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+	}))
+
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "notes.txt")
+
+	if err := os.WriteFile(path, []byte("file"), 0o600); err != nil {
+		t.Fatalf("Unexpected error while writing file: %v", err)
+	}
+
+	client := MustNew(WithRetry(&Retry{Max: 2}))
+
+	form := func(reader io.Reader) MultipartForm {
+		return MultipartForm{Parts: []MultipartPart{
+			MultipartField("user", "jane"),
+			MultipartFile("file", path),
+			MultipartReader("reader", "reader.txt", reader),
+		}}
+	}
+
+	res, err := client.Post(server.URL, form(strings.NewReader("reader")))
+
+	if err != nil {
+		t.Fatalf("Unexpected error while posting form: %v", err)
+	}
+
+	var received receivedMultipart
+
+	if err := json.Unmarshal(res.Body, &received); err != nil {
+		t.Fatalf("Unexpected response %s: %v", res.BodyString(), err)
+	}
+
+	expected := []receivedPart{
+		{Name: "user", Content: "jane"},
+		{Name: "file", FileName: "notes.txt", ContentType: "text/plain", Content: "file"},
+		{Name: "reader", FileName: "reader.txt", ContentType: "text/plain", Content: "reader"},
+	}
+
+	if attempts.Load() != 2 || !reflect.DeepEqual(received.Parts, expected) {
+		t.Errorf("Unexpected parts after %d attempts, expected: %+v got: %+v", attempts.Load(), expected, received.Parts)
+	}
+
+	attempts.Store(1)
+
+	// hides the Seek of the strings.Reader
+	reader := struct{ io.Reader }{strings.NewReader("reader")}
+
+	if _, err := MustNew().Post(server.URL, form(reader)); !errors.Is(err, ErrMultipartReplay) {
+		t.Errorf("Unexpected error for a reader that can't seek: %v", err)
+	}
+}
+
+func TestMultipartFormErrors(t *testing.T) {
+	client := MustNew()
+
+	_, err := client.NewRequest("http://127.0.0.1/", MultipartForm{Boundary: "bad\"boundary"})
+
+	if !errors.Is(err, ErrMultipartBoundary) {
+		t.Errorf("Unexpected error for invalid boundary: %v", err)
+	}
+
+	_, err = client.NewRequest("http://127.0.0.1/", MultipartForm{
+		Parts: []MultipartPart{MultipartFile("file", filepath.Join(t.TempDir(), "missing"))},
+	})
+
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Unexpected error for missing file: %v", err)
+	}
+}
+
+func TestWebKitBoundary(t *testing.T) {
+	boundary := WebKitBoundary()
+
+	if len(boundary) != 38 || !strings.HasPrefix(boundary, "----WebKitFormBoundary") || !validBoundary(boundary) {
+		t.Errorf("Unexpected boundary: %s", boundary)
+	}
+
+	if boundary == WebKitBoundary() {
+		t.Errorf("Boundaries repeat: %s", boundary)
+	}
+}
@@ -1,31 +1,45 @@
 package http_client
 
-import (
-	"time"
+import "errors"
 
-	"github.com/vimbing/retry"
-)
+// NewClient returns a client configured by options.
+func NewClient(options ...ClientOption) (*Client, error) {
+	return New(anyOptions(options)...)
+}
+
+// MustNewClient is like NewClient but panics when the client can't be
+// created.
+func MustNewClient(options ...ClientOption) *Client {
+	return MustNew(anyOptions(options)...)
+}
 
+// New returns a client configured by options, values that are not a
+// ClientOption make it fail with ErrUnknownOption.
+//
+// Deprecated: use NewClient, which checks the options at compile time.
 func New(options ...any) (*Client, error) {
 	cfg := parseOptions(options...)
 
+	if len(cfg.optionErrors) > 0 {
+		return nil, errors.Join(cfg.optionErrors...)
+	}
+
 	c := &Client{
 		cfg: cfg,
 	}
 
+	bindResolverClient(cfg.resolver, c)
+
 	err := c.reinitFhttpClient()
 
 	return c, err
 }
 
+// MustNew is like New but panics when the client can't be created.
+//
+// Deprecated: use MustNewClient, which checks the options at compile time.
 func MustNew(options ...any) *Client {
-	client := &Client{}
-
-	err := retry.Retrier{Max: 15, Delay: time.Millisecond * 15}.Retry(func() error {
-		var err error
-		client, err = New(options...)
-		return err
-	})
+	client, err := New(options...)
 
 	if err != nil {
 		panic(err)
@@ -33,3 +47,13 @@ func MustNew(options ...any) *Client {
 
 	return client
 }
+
+func anyOptions[T any](options []T) []any {
+	converted := make([]any, len(options))
+
+	for i, option := range options {
+		converted[i] = option
+	}
+
+	return converted
+}
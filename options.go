@@ -1,24 +1,73 @@
 package http_client
 
 import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
 	"time"
 
 	"github.com/repeale/fp-go"
 	lo "github.com/samber/lo"
 	"github.com/vimbing/fhttp/cookiejar"
 	tls "github.com/vimbing/utls"
+	"golang.org/x/net/proxy"
 )
 
+// ClientOption configures a Client, the With functions return them.
+type ClientOption interface {
+	clientOption()
+}
+
+func (OptionTimeout) clientOption()                     {}
+func (OptionTimeouts) clientOption()                    {}
+func (OptionProxy) clientOption()                       {}
+func (OptionProxyList) clientOption()                   {}
+func (OptionDisallowRedirect) clientOption()            {}
+func (OptionForcedProxyRotation) clientOption()         {}
+func (OptionTLSHelloID) clientOption()                  {}
+func (OptionTlsProfile) clientOption()                  {}
+func (OptionInsecureSkipVerify) clientOption()          {}
+func (OptionJar) clientOption()                         {}
+func (OptionRequestMiddleware) clientOption()           {}
+func (OptionResponseMiddleware) clientOption()          {}
+func (OptionResponseErrorMiddleware) clientOption()     {}
+func (OptionRetryPolicy) clientOption()                 {}
+func (OptionStatusValidationFunc) clientOption()        {}
+func (OptionResolver) clientOption()                    {}
+func (OptionLocalAddrs) clientOption()                  {}
+func (OptionIPFamily) clientOption()                    {}
+func (OptionTLSSessionCache) clientOption()             {}
+func (OptionDisableTLSSessionResumption) clientOption() {}
+func (OptionKeyLogWriter) clientOption()                {}
+func (OptionKeyLogFromEnv) clientOption()               {}
+func (OptionRootCAPool) clientOption()                  {}
+func (OptionECHFromDNS) clientOption()                  {}
+func (OptionTLSSeed) clientOption()                     {}
+func (OptionHooks) clientOption()                       {}
+func (OptionProtocol) clientOption()                    {}
+func (OptionALPN) clientOption()                        {}
+func (OptionH2C) clientOption()                         {}
+func (OptionDialer) clientOption()                      {}
+func (OptionPool) clientOption()                        {}
+func (OptionHostTlsProfile) clientOption()              {}
+func (OptionECHConfigList) clientOption()               {}
+func (OptionCertificatePins) clientOption()             {}
+func (OptionClientCertificate) clientOption()           {}
+
 func WithForcedProxyRotation() OptionForcedProxyRotation {
 	return true
 }
 
-func WithProxyList(proxyList []string) []OptionProxy {
-	return append([]OptionProxy{}, parseList(proxyList)...)
+func WithProxyList(proxyList []string) OptionProxyList {
+	return append(OptionProxyList{}, parseList(proxyList)...)
 }
 
-func WithProxyListParsed(proxyList []string) []OptionProxy {
-	return append([]OptionProxy{}, lo.Map(proxyList, func(p string, i int) OptionProxy { return OptionProxy(p) })...)
+func WithProxyListParsed(proxyList []string) OptionProxyList {
+	return append(OptionProxyList{}, lo.Map(proxyList, func(p string, i int) OptionProxy { return OptionProxy(p) })...)
 }
 
 func WithProxy(proxy string) OptionProxy {
@@ -47,6 +96,174 @@ func WithCustomTimeout(timeout time.Duration) OptionTimeout {
 	return OptionTimeout(timeout)
 }
 
+// WithTimeouts sets per-phase timeouts, zero fields keep their defaults.
+func WithTimeouts(timeouts Timeouts) OptionTimeouts {
+	return OptionTimeouts(timeouts)
+}
+
+// WithResolver replaces the system resolver, for direct connections and
+// for the proxy hosts alike.
+func WithResolver(resolver Resolver) OptionResolver {
+	return OptionResolver{resolver}
+}
+
+// WithLocalAddr binds outgoing connections to the given source addresses.
+// With more than one address they are used in turn. New fails when an
+// address is invalid or none is given.
+func WithLocalAddr(addrs ...string) OptionLocalAddrPool {
+	if len(addrs) == 0 {
+		return &LocalAddrPool{err: errors.New("no local address given")}
+	}
+
+	pool, err := NewLocalAddrPool(addrs...)
+
+	if err != nil {
+		return &LocalAddrPool{err: err}
+	}
+
+	return pool
+}
+
+// WithLocalAddrPool binds outgoing connections to the addresses of pool,
+// which can be shared with other clients.
+func WithLocalAddrPool(pool *LocalAddrPool) OptionLocalAddrPool {
+	return OptionLocalAddrPool(pool)
+}
+
+func WithIPFamily(family IPFamily) OptionIPFamily {
+	return OptionIPFamily(family)
+}
+
+// WithTLSSessionCache stores TLS sessions in cache instead of a cache private
+// to the client, sharing one cache between clients lets them resume each
+// other's sessions. Sessions are kept apart per proxy, a ticket is never
+// resumed through another exit than the one it was issued to. Resumed
+// connections don't send early data.
+func WithTLSSessionCache(cache tls.ClientSessionCache) OptionTLSSessionCache {
+	return OptionTLSSessionCache{cache}
+}
+
+func WithoutTLSSessionResumption() OptionDisableTLSSessionResumption {
+	return true
+}
+
+// WithKeyLogWriter writes the TLS secrets of every connection, including
+// the one to an HTTPS proxy, to w in NSS key log format so captures can be
+// decrypted in Wireshark.
+func WithKeyLogWriter(w io.Writer) OptionKeyLogWriter {
+	return OptionKeyLogWriter{w}
+}
+
+// WithKeyLogFromEnv appends TLS secrets to the file named by SSLKEYLOGFILE
+// when it is set. A writer passed to WithKeyLogWriter takes precedence.
+func WithKeyLogFromEnv() OptionKeyLogFromEnv {
+	return true
+}
+
+// WithECHConfigList offers Encrypted Client Hello to host, exact or a
+// wildcard like *.example.com, using the serialized ECHConfigList the server
+// publishes. Connections with ECH require TLS 1.3. A server rejecting the
+// configs gets one more handshake, with the configs it sent back or without
+// ECH when it sent none.
+func WithECHConfigList(host string, configList []byte) OptionECHConfigList {
+	return OptionECHConfigList{host: host, configList: configList}
+}
+
+// WithECHFromDNS fetches ECH configs from the DNS HTTPS record of every host
+// through the client's resolver, New fails unless it implements ECHResolver.
+// Hosts without a record get the profile's GREASE ECH, if any.
+func WithECHFromDNS() OptionECHFromDNS {
+	return true
+}
+
+// WithTLSSeed derives every random value of the TLS handshakes from seed,
+// including the extension order, GREASE values and key shares, so tests can
+// assert exact ClientHello bytes. The handshakes are not secure, never use
+// it outside of tests.
+func WithTLSSeed(seed uint64) OptionTLSSeed {
+	return OptionTLSSeed(seed)
+}
+
+// WithHostTlsProfile uses profile for hosts matching pattern, an exact host
+// or a wildcard like *.example.com, instead of the client's profile.
+// Patterns are tried in the order they were added.
+func WithHostTlsProfile(pattern string, profile TlsProfile) OptionHostTlsProfile {
+	return OptionHostTlsProfile{pattern: pattern, profile: profile}
+}
+
+// WithHostTlsProfileRegexp is like WithHostTlsProfile, but matches hosts
+// against the regular expression expr. New fails if expr does not compile.
+func WithHostTlsProfileRegexp(expr string, profile TlsProfile) OptionHostTlsProfile {
+	return OptionHostTlsProfile{pattern: expr, regexp: true, profile: profile}
+}
+
+// WithHooks calls hooks for every request of the client.
+func WithHooks(hooks Hooks) OptionHooks {
+	return OptionHooks(hooks)
+}
+
+// WithProtocol makes the client offer, and insist on, only the given HTTP
+// version. Request.SetProtocol overrides it per request.
+func WithProtocol(protocol Protocol) OptionProtocol {
+	return OptionProtocol(protocol)
+}
+
+// WithALPN offers protocols in the ClientHello instead of the profile's
+// ALPN list. It applies while the protocol preference is ProtocolAuto.
+func WithALPN(protocols ...string) OptionALPN {
+	return OptionALPN(protocols)
+}
+
+// WithH2C lets http:// requests use HTTP/2 in cleartext, with the SETTINGS
+// of the profile.
+func WithH2C(mode H2CMode) OptionH2C {
+	return OptionH2C(mode)
+}
+
+// WithDialer makes connections, or the ones to the proxy, through dialer
+// instead of dialing TCP directly. TLS is still done by the client on top
+// of the returned connections.
+func WithDialer(dialer proxy.ContextDialer) OptionDialer {
+	return OptionDialer{dialer}
+}
+
+// WithPool limits the connections and HTTP/2 streams used per host, see
+// Client.PoolStats for their state.
+func WithPool(settings PoolSettings) OptionPool {
+	return OptionPool(settings)
+}
+
+// WithRootCAs verifies server certificates against pool instead of the
+// system roots.
+func WithRootCAs(pool *x509.CertPool) OptionRootCAs {
+	return OptionRootCAs(pool)
+}
+
+// WithSPKIPins pins host, exact or a wildcard like *.example.com, to
+// certificates whose public key hashes to one of pins. Pins are base64
+// SHA-256 digests, optionally prefixed with "sha256/".
+func WithSPKIPins(host string, pins ...string) OptionCertificatePins {
+	return OptionCertificatePins{host: host, kind: PinSPKISHA256, pins: pins}
+}
+
+// WithCertificateHashPins is like WithSPKIPins, but pins the digest of the
+// whole certificate.
+func WithCertificateHashPins(host string, pins ...string) OptionCertificatePins {
+	return OptionCertificatePins{host: host, kind: PinCertificateSHA256, pins: pins}
+}
+
+// WithClientCertificate presents cert when the server asks for a client
+// certificate.
+func WithClientCertificate(cert tls.Certificate) OptionClientCertificate {
+	return OptionClientCertificate{cert: cert}
+}
+
+// WithClientCertificateFiles loads a PEM encoded certificate and key, New
+// fails if they cannot be loaded.
+func WithClientCertificateFiles(certFile, keyFile string) OptionClientCertificate {
+	return OptionClientCertificate{certFile: certFile, keyFile: keyFile}
+}
+
 func WithInsecureSkipVerify() OptionInsecureSkipVerify {
 	return OptionInsecureSkipVerify(true)
 }
@@ -79,11 +296,14 @@ func parseOptions(options ...any) *Config {
 	defaultCfg := &Config{
 		proxies:              []string{},
 		allowRedirect:        true,
-		timeout:              time.Second * 15,
 		transportSettings:    TransportSettings{},
 		jar:                  nil,
 		retry:                &Retry{},
 		statusValidationFunc: nil,
+		timeouts: Timeouts{
+			Total: time.Second * 15,
+			Dial:  time.Second * 30,
+		},
 	}
 
 	for _, opt := range options {
@@ -92,12 +312,16 @@ func parseOptions(options ...any) *Config {
 			defaultCfg.forceRotation = true
 		case OptionProxy:
 			defaultCfg.proxies = []string{string(v)}
+		case OptionProxyList:
+			defaultCfg.proxies = fp.Map(func(p OptionProxy) string { return string(p) })(v)
 		case []OptionProxy:
 			defaultCfg.proxies = fp.Map(func(p OptionProxy) string { return string(p) })(v)
 		case OptionDisallowRedirect:
 			defaultCfg.allowRedirect = false
 		case OptionCookieJar:
 			defaultCfg.jar = v
+		case OptionJar:
+			defaultCfg.jar = v.Jar
 		case OptionStatusValidationFunc:
 			defaultCfg.statusValidationFunc = StatusValidationFunc(v)
 		case OptionResponseMiddleware:
@@ -113,13 +337,19 @@ func parseOptions(options ...any) *Config {
 				defaultCfg.responseErrorMiddleware = append(defaultCfg.responseErrorMiddleware, ResponseErrorMiddlewareFunc(m))
 			}
 		case OptionTimeout:
-			defaultCfg.timeout = time.Duration(v)
+			defaultCfg.timeouts.Total = time.Duration(v)
+		case OptionTimeouts:
+			defaultCfg.timeouts = defaultCfg.timeouts.merge(Timeouts(v))
 		case OptionTLSHelloID:
 			defaultCfg.transportSettings.HelloID = tls.ClientHelloID(v)
 		case OptionTlsProfile:
 			p := TlsProfile(v)
 			defaultCfg.transportSettings = p.TransportSettings
 
+			if err := validateFlow(p.TransportSettings); err != nil {
+				defaultCfg.optionErrors = append(defaultCfg.optionErrors, err)
+			}
+
 			// bogdanHelloID := p.GetClientHelloId()
 			// bogdanSpec, err := p.GetClientHelloSpec()
 			// var spec *tls.ClientHelloSpec
@@ -169,12 +399,184 @@ func parseOptions(options ...any) *Config {
 
 			// TODO
 			// defaultCfg.transportSettings.DisablePush = p
+		case OptionResolver:
+			defaultCfg.resolver = v.Resolver
+		case OptionLocalAddrPool:
+			defaultCfg.setLocalAddrs(v)
+		case OptionLocalAddrs:
+			defaultCfg.setLocalAddrs(v.LocalAddrPool)
+		case OptionIPFamily:
+			defaultCfg.ipFamily = IPFamily(v)
+		case OptionTLSSessionCache:
+			defaultCfg.tlsSessionCache = v.ClientSessionCache
+		case OptionDisableTLSSessionResumption:
+			defaultCfg.disableTLSResumption = true
+		case OptionKeyLogWriter:
+			defaultCfg.keyLogWriter = v.Writer
+		case OptionKeyLogFromEnv:
+			defaultCfg.keyLogFromEnv = bool(v)
+		case OptionECHConfigList:
+			defaultCfg.echConfigs = append(defaultCfg.echConfigs, echConfigList{
+				hostPattern: v.host,
+				configList:  v.configList,
+			})
+		case OptionECHFromDNS:
+			defaultCfg.echFromDNS = bool(v)
+		case OptionTLSSeed:
+			defaultCfg.tlsRand = newSeededReader(uint64(v))
+		case OptionHostTlsProfile:
+			hostProfile, err := v.parse()
+
+			if err != nil {
+				defaultCfg.optionErrors = append(defaultCfg.optionErrors, err)
+				continue
+			}
+
+			defaultCfg.hostProfiles = append(defaultCfg.hostProfiles, hostProfile)
+		case OptionHooks:
+			defaultCfg.hooks = Hooks(v)
+		case OptionProtocol:
+			defaultCfg.protocol = Protocol(v)
+		case OptionALPN:
+			defaultCfg.alpn = append([]string{}, v...)
+		case OptionH2C:
+			defaultCfg.h2c = H2CMode(v)
+		case OptionDialer:
+			defaultCfg.dialer = v.ContextDialer
+		case OptionPool:
+			defaultCfg.pool = PoolSettings(v)
+		case OptionRootCAs:
+			defaultCfg.rootCAs = v
+		case OptionRootCAPool:
+			defaultCfg.rootCAs = v.CertPool
+		case OptionCertificatePins:
+			pins, err := v.parse()
+
+			if err != nil {
+				defaultCfg.optionErrors = append(defaultCfg.optionErrors, err)
+				continue
+			}
+
+			defaultCfg.certificatePins = append(defaultCfg.certificatePins, pins)
+		case OptionClientCertificate:
+			cert, err := v.load()
+
+			if err != nil {
+				defaultCfg.optionErrors = append(defaultCfg.optionErrors, err)
+				continue
+			}
+
+			defaultCfg.clientCertificates = append(defaultCfg.clientCertificates, cert)
 		case OptionInsecureSkipVerify:
 			defaultCfg.insecureSkipVerify = true
 		case OptionRetry:
 			defaultCfg.retry = v
+		case OptionRetryPolicy:
+			defaultCfg.retry = v.Retry
+		case nil:
+		default:
+			defaultCfg.optionErrors = append(defaultCfg.optionErrors, unknownOption(opt))
 		}
 	}
 
+	if defaultCfg.echFromDNS && !echCapable(defaultCfg.resolver) {
+		defaultCfg.optionErrors = append(defaultCfg.optionErrors, errors.New("WithECHFromDNS needs a resolver implementing ECHResolver"))
+	}
+
+	if defaultCfg.tlsSessionCache == nil {
+		defaultCfg.tlsSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+
+	if defaultCfg.keyLogWriter != nil {
+		defaultCfg.keyLogWriter = &lockedWriter{w: defaultCfg.keyLogWriter}
+	} else if defaultCfg.keyLogFromEnv {
+		w, err := openKeyLogFile()
+
+		if err != nil {
+			defaultCfg.optionErrors = append(defaultCfg.optionErrors, err)
+		}
+
+		defaultCfg.keyLogWriter = w
+	}
+
 	return defaultCfg
 }
+
+func (cfg *Config) setLocalAddrs(pool *LocalAddrPool) {
+	if pool != nil && pool.err != nil {
+		cfg.optionErrors = append(cfg.optionErrors, pool.err)
+		return
+	}
+
+	cfg.localAddrs = pool
+}
+
+func (cfg *Config) clone() *Config {
+	cloned := *cfg
+
+	cloned.proxies = append([]string{}, cfg.proxies...)
+	cloned.requestMiddleware = append([]RequestMiddlewareFunc{}, cfg.requestMiddleware...)
+	cloned.responseMiddleware = append([]ResponseMiddlewareFunc{}, cfg.responseMiddleware...)
+	cloned.responseErrorMiddleware = append([]ResponseErrorMiddlewareFunc{}, cfg.responseErrorMiddleware...)
+
+	return &cloned
+}
+
+func (cfg *Config) helloShaping(settings TransportSettings, protocol Protocol) helloShaping {
+	return helloShaping{
+		shuffleExtensions: settings.ShuffleExtensions,
+		grease:            settings.GREASE,
+		padding:           settings.Padding,
+		alpn:              protocol.alpn(cfg.alpn),
+		rand:              cfg.tlsRand,
+	}
+}
+
+func (cfg *Config) tlsOptions(settings TransportSettings, proxy string) tlsOptions {
+	options := tlsOptions{
+		sessionCache:       proxySessionCache(cfg.tlsSessionCache, proxy),
+		rootCAs:            cfg.rootCAs,
+		clientCertificates: cfg.clientCertificates,
+		pins:               cfg.certificatePins,
+		keyLogWriter:       cfg.keyLogWriter,
+		echConfigs:         cfg.echConfigs,
+	}
+
+	if cfg.echFromDNS {
+		options.echResolver, _ = cfg.resolver.(ECHResolver)
+	}
+
+	if cfg.disableTLSResumption || settings.DisableSessionResumption {
+		options.sessionCache = nil
+	}
+
+	return options
+}
+
+func (o OptionCertificatePins) parse() (certificatePins, error) {
+	pins := certificatePins{hostPattern: o.host, kind: o.kind}
+
+	if len(o.pins) == 0 {
+		return pins, fmt.Errorf("no certificate pins given for host %s", o.host)
+	}
+
+	for _, pin := range o.pins {
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+
+		if err != nil || len(hash) != sha256.Size {
+			return pins, fmt.Errorf("invalid certificate pin %q for host %s", pin, o.host)
+		}
+
+		pins.hashes = append(pins.hashes, hash)
+	}
+
+	return pins, nil
+}
+
+func (o OptionClientCertificate) load() (tls.Certificate, error) {
+	if len(o.certFile) == 0 {
+		return o.cert, nil
+	}
+
+	return tls.LoadX509KeyPair(o.certFile, o.keyFile)
+}
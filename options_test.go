@@ -0,0 +1,55 @@
+package http_client
+
+import (
+	"crypto/x509"
+	"errors"
+	"testing"
+
+	"github.com/vimbing/fhttp/cookiejar"
+)
+
+func TestNewUnknownOption(t *testing.T) {
+	for _, option := range []any{"GET", QueryParams{"a": "1"}, 15, OptionStringJa("ja3")} {
+		if _, err := New(option); !errors.Is(err, ErrUnknownOption) {
+			t.Errorf("Unexpected error for %T: %v", option, err)
+		}
+	}
+
+	if _, err := New(nil, WithProxyList([]string{"127.0.0.1:8080"}), []OptionProxy{"http://127.0.0.1:8080"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	pool, _ := NewLocalAddrPool("127.0.0.1")
+
+	if _, err := NewClient(WithInsecureSkipVerify(), OptionRetryPolicy{&Retry{}}, OptionLocalAddrs{pool}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestPointerOptions(t *testing.T) {
+	jar, _ := cookiejar.New(nil)
+	retry := &Retry{Max: 2}
+	pool, _ := NewLocalAddrPool("127.0.0.1")
+	roots := x509.NewCertPool()
+
+	clients := []func() (*Client, error){
+		func() (*Client, error) {
+			return New(WithCookieJar(jar), WithRetry(retry), WithLocalAddrPool(pool), WithRootCAs(roots))
+		},
+		func() (*Client, error) {
+			return NewClient(OptionJar{jar}, OptionRetryPolicy{retry}, OptionLocalAddrs{pool}, OptionRootCAPool{roots})
+		},
+	}
+
+	for i, newClient := range clients {
+		client, err := newClient()
+
+		if err != nil {
+			t.Fatalf("Unexpected error for client %d: %v", i, err)
+		}
+
+		if cfg := client.snapshot().cfg; cfg.jar != jar || cfg.retry != retry || cfg.localAddrs != pool || cfg.rootCAs != roots {
+			t.Errorf("Pointer options were not applied to client %d", i)
+		}
+	}
+}
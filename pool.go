@@ -0,0 +1,609 @@
+package http_client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	http "github.com/vimbing/fhttp"
+	"github.com/vimbing/fhttp/http2"
+	"github.com/vimbing/fhttp/httptrace"
+	tls "github.com/vimbing/utls"
+)
+
+// PoolStats describes the connections a client keeps to one address.
+type PoolStats struct {
+	// Addr is the host:port the connections go to.
+	Addr string
+	// Protocol is "h2" or "http/1.1".
+	Protocol string
+
+	// Connections is the number of open connections, IdleConnections the
+	// ones carrying no request. For HTTP/1.1 the idle ones are estimated
+	// from the active requests.
+	Connections     int
+	IdleConnections int
+
+	// ActiveRequests counts the requests sent or waiting for a connection
+	// whose response body was not closed yet.
+	ActiveRequests int
+
+	// TotalConnections and TotalRequests count everything since the
+	// transport was bound, rotating the proxy starts them over.
+	TotalConnections int
+	TotalRequests    int
+}
+
+// PoolStats returns the state of the connection pools, one entry per
+// address and protocol.
+func (c *Client) PoolStats() []PoolStats {
+	transport, ok := c.snapshot().fhttpClient.Transport.(*profileRoundTripper)
+
+	if !ok {
+		return nil
+	}
+
+	return transport.poolStats()
+}
+
+func (p *profileRoundTripper) poolStats() []PoolStats {
+	p.mu.Lock()
+	roundTrippers := p.roundTrippers.values()
+	p.mu.Unlock()
+
+	// profiles keep separate pools, they are summed per address
+	merged := make(map[[2]string]*PoolStats)
+
+	for _, rt := range roundTrippers {
+		for _, stats := range rt.poolStats() {
+			key := [2]string{stats.Addr, stats.Protocol}
+
+			if total, ok := merged[key]; ok {
+				total.Connections += stats.Connections
+				total.IdleConnections += stats.IdleConnections
+				total.ActiveRequests += stats.ActiveRequests
+				total.TotalConnections += stats.TotalConnections
+				total.TotalRequests += stats.TotalRequests
+				continue
+			}
+
+			merged[key] = &stats
+		}
+	}
+
+	result := make([]PoolStats, 0, len(merged))
+
+	for _, stats := range merged {
+		result = append(result, *stats)
+	}
+
+	slices.SortFunc(result, func(a, b PoolStats) int {
+		if c := strings.Compare(a.Addr, b.Addr); c != 0 {
+			return c
+		}
+
+		return strings.Compare(a.Protocol, b.Protocol)
+	})
+
+	return result
+}
+
+// poolCounters counts the connections and requests of one address.
+type poolCounters struct {
+	connections      int
+	activeRequests   int
+	totalConnections int
+	totalRequests    int
+}
+
+func (rt *roundTripper) counters(addr string, update func(c *poolCounters)) {
+	rt.statsMu.Lock()
+	defer rt.statsMu.Unlock()
+
+	counters, ok := rt.stats[addr]
+
+	if !ok {
+		counters = &poolCounters{}
+		rt.stats[addr] = counters
+	}
+
+	update(counters)
+}
+
+func (rt *roundTripper) poolStats() []PoolStats {
+	rt.Lock()
+	transports := make(map[string]http.RoundTripper, len(rt.cachedTransports))
+
+	for addr, transport := range rt.cachedTransports {
+		transports[addr] = transport
+	}
+	rt.Unlock()
+
+	rt.statsMu.Lock()
+	counters := make(map[string]poolCounters, len(rt.stats))
+
+	for addr, c := range rt.stats {
+		counters[addr] = *c
+	}
+	rt.statsMu.Unlock()
+
+	result := make([]PoolStats, 0, len(counters))
+
+	for addr, c := range counters {
+		stats := PoolStats{
+			Addr:             addr,
+			Protocol:         protocolHTTP1,
+			Connections:      c.connections,
+			IdleConnections:  max(c.connections-c.activeRequests, 0),
+			ActiveRequests:   c.activeRequests,
+			TotalConnections: c.totalConnections,
+			TotalRequests:    c.totalRequests,
+		}
+
+		if pool, ok := transports[addr].(*http2Pool); ok {
+			stats.Protocol = http2.NextProtoTLS
+			stats.IdleConnections = pool.idle()
+		}
+
+		result = append(result, stats)
+	}
+
+	return result
+}
+
+// trackConn counts conn as open to addr until it is closed.
+func (rt *roundTripper) trackConn(addr string, conn net.Conn) net.Conn {
+	rt.counters(addr, func(c *poolCounters) {
+		c.connections++
+		c.totalConnections++
+	})
+
+	tracked := &trackedConn{Conn: conn}
+	tracked.onClose = func() {
+		rt.counters(addr, func(c *poolCounters) { c.connections-- })
+	}
+
+	return withConnectionState(tracked, conn)
+}
+
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	onClose func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.onClose)
+	return c.Conn.Close()
+}
+
+// withConnectionState returns wrapper exposing the TLS state of conn, if it
+// has one, so it stays visible to the transports and ConnInfo.
+func withConnectionState(wrapper, conn net.Conn) net.Conn {
+	if stater, ok := conn.(connectionStater); ok {
+		return &tlsStateConn{Conn: wrapper, stater: stater}
+	}
+
+	return wrapper
+}
+
+type tlsStateConn struct {
+	net.Conn
+	stater connectionStater
+}
+
+func (c *tlsStateConn) ConnectionState() tls.ConnectionState {
+	return c.stater.ConnectionState()
+}
+
+// releaseBody calls release once the body was read to the end or closed.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	if err == io.EOF {
+		b.once.Do(b.release)
+	}
+
+	return n, err
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+
+	return err
+}
+
+// releaseOnBodyClose calls release when the body of res is done with, or
+// right away when there is none.
+func releaseOnBodyClose(res *http.Response, release func()) {
+	if res.Body == nil || res.Body == http.NoBody {
+		release()
+		return
+	}
+
+	res.Body = &releaseBody{ReadCloser: res.Body, release: release}
+}
+
+// newHTTP1Transport returns an HTTP/1.1 transport limited by the pool
+// settings, the caller sets how it dials.
+func (rt *roundTripper) newHTTP1Transport() *http.Transport {
+	return &http.Transport{
+		MaxConnsPerHost:     rt.pool.MaxConnsPerHost,
+		MaxIdleConnsPerHost: rt.pool.MaxIdleConnsPerHost,
+		IdleConnTimeout:     rt.pool.IdleConnTimeout,
+		DisableKeepAlives:   rt.pool.DisableKeepAlives,
+	}
+}
+
+// http2Pool keeps the HTTP/2 connections to one address. Unlike the pool of
+// http2.Transport it caps the streams of every connection and the number
+// of connections, requests beyond both wait for a stream to free up.
+type http2Pool struct {
+	t2       *http2.Transport
+	dial     func(ctx context.Context) (net.Conn, error)
+	settings PoolSettings
+
+	pseudoHeaderOrder []string
+
+	// t2Mu serializes NewClientConn, it fills in the SETTINGS of t2
+	t2Mu sync.Mutex
+
+	mu      sync.Mutex
+	conns   []*pooledConn
+	dialing int
+	waiting int
+	// changed is closed and replaced whenever a stream or connection
+	// becomes available
+	changed chan struct{}
+}
+
+type pooledConn struct {
+	cc        *http2.ClientConn
+	conn      net.Conn
+	streams   int
+	used      bool
+	idleTimer *time.Timer
+}
+
+// newHTTP2Pool returns the pool of rt for one address, its connections are
+// opened with dial and t2.
+func (rt *roundTripper) newHTTP2Pool(t2 *http2.Transport, dial func(ctx context.Context) (net.Conn, error)) *http2Pool {
+	return &http2Pool{
+		t2:                t2,
+		dial:              dial,
+		settings:          rt.pool,
+		pseudoHeaderOrder: rt.pseudoHeaderOrder,
+		changed:           make(chan struct{}),
+	}
+}
+
+func (p *http2Pool) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = withPseudoHeaderOrder(req, p.pseudoHeaderOrder)
+
+	for attempt := 0; ; attempt++ {
+		pc, reused, err := p.acquire(req.Context())
+
+		if err != nil {
+			return nil, err
+		}
+
+		if trace := httptrace.ContextClientTrace(req.Context()); trace != nil && trace.GotConn != nil {
+			trace.GotConn(httptrace.GotConnInfo{Conn: pc.conn, Reused: reused})
+		}
+
+		res, err := pc.cc.RoundTrip(req)
+
+		if err != nil {
+			p.release(pc)
+
+			// the server may have closed a reused connection meanwhile, only
+			// requests it never processed are sent again
+			if reused && attempt == 0 && canRetryHTTP2(err) && req.Context().Err() == nil {
+				if rewound, rewindErr := rewindRequest(req, err); rewindErr == nil {
+					req = rewound
+					continue
+				}
+			}
+
+			return nil, err
+		}
+
+		releaseOnBodyClose(res, func() { p.release(pc) })
+
+		return res, nil
+	}
+}
+
+// canRetryHTTP2 reports whether err says the server didn't process the
+// request: the connection was unusable, a GOAWAY came in before the stream
+// or the server refused the stream.
+func canRetryHTTP2(err error) bool {
+	var streamErr http2.StreamError
+
+	if errors.As(err, &streamErr) {
+		return streamErr.Code == http2.ErrCodeRefusedStream
+	}
+
+	return errors.Is(err, http2.ErrClientConnUnusable) || errors.Is(err, http2.ErrClientConnGotGoAway)
+}
+
+// streamLimit is the number of streams a connection may carry, zero leaves
+// it to the server.
+func (p *http2Pool) streamLimit() int {
+	if p.settings.DisableKeepAlives {
+		return 1
+	}
+
+	return p.settings.MaxConcurrentStreams
+}
+
+// acquire reserves a stream on a pooled connection, dialing one when all of
+// them are busy and the limit allows it.
+func (p *http2Pool) acquire(ctx context.Context) (*pooledConn, bool, error) {
+	for {
+		p.mu.Lock()
+		stale := p.pruneLocked()
+
+		if pc := p.availableLocked(); pc != nil {
+			reused := pc.used
+			pc.used = true
+			pc.streams++
+
+			if pc.idleTimer != nil {
+				pc.idleTimer.Stop()
+				pc.idleTimer = nil
+			}
+
+			p.mu.Unlock()
+			closeConns(stale)
+
+			return pc, reused, nil
+		}
+
+		if p.canDialLocked() {
+			p.dialing++
+			p.mu.Unlock()
+			closeConns(stale)
+
+			return p.dialConn(ctx)
+		}
+
+		p.waiting++
+		changed := p.changed
+		p.mu.Unlock()
+		closeConns(stale)
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+
+		p.mu.Lock()
+		p.waiting--
+		p.mu.Unlock()
+
+		if err := ctx.Err(); err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+func (p *http2Pool) dialConn(ctx context.Context) (*pooledConn, bool, error) {
+	conn, err := p.dial(ctx)
+
+	var cc *http2.ClientConn
+
+	if err == nil {
+		p.t2Mu.Lock()
+		cc, err = p.t2.NewClientConn(conn)
+		p.t2Mu.Unlock()
+
+		if err != nil {
+			_ = conn.Close()
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.dialing--
+	p.notifyLocked()
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	// the dialing request gets the first stream
+	pc := &pooledConn{cc: cc, conn: conn, streams: 1, used: true}
+	p.conns = append(p.conns, pc)
+
+	return pc, false, nil
+}
+
+func (p *http2Pool) availableLocked() *pooledConn {
+	limit := p.streamLimit()
+
+	for _, pc := range p.conns {
+		if p.settings.DisableKeepAlives && pc.used {
+			continue
+		}
+
+		if limit > 0 && pc.streams >= limit {
+			continue
+		}
+
+		if pc.cc.CanTakeNewRequest() {
+			return pc
+		}
+	}
+
+	return nil
+}
+
+// canDialLocked reports whether a new connection may be opened. Dials are
+// shared, another one only starts when the waiting requests exceed what
+// the ones in flight will carry.
+func (p *http2Pool) canDialLocked() bool {
+	if limit := p.settings.MaxConnsPerHost; limit > 0 && len(p.conns)+p.dialing >= limit {
+		return false
+	}
+
+	if p.dialing == 0 {
+		return true
+	}
+
+	streams := p.streamLimit()
+
+	return streams > 0 && p.waiting+1 > p.dialing*streams
+}
+
+// pruneLocked drops the idle connections that can't take requests anymore
+// and returns them for closing.
+func (p *http2Pool) pruneLocked() []*pooledConn {
+	var stale []*pooledConn
+
+	p.conns = slices.DeleteFunc(p.conns, func(pc *pooledConn) bool {
+		if pc.streams == 0 && !pc.cc.CanTakeNewRequest() {
+			stale = append(stale, pc)
+			return true
+		}
+
+		return false
+	})
+
+	if len(stale) > 0 {
+		p.notifyLocked()
+	}
+
+	return stale
+}
+
+func (p *http2Pool) release(pc *pooledConn) {
+	p.mu.Lock()
+
+	pc.streams--
+
+	var stale []*pooledConn
+
+	if pc.streams == 0 {
+		switch {
+		case p.settings.DisableKeepAlives || !pc.cc.CanTakeNewRequest():
+			p.removeLocked(pc)
+			stale = append(stale, pc)
+		case p.settings.IdleConnTimeout > 0:
+			pc.idleTimer = time.AfterFunc(p.settings.IdleConnTimeout, func() { p.closeIdle(pc) })
+		}
+	}
+
+	p.notifyLocked()
+	p.mu.Unlock()
+
+	closeConns(stale)
+}
+
+func (p *http2Pool) closeIdle(pc *pooledConn) {
+	p.mu.Lock()
+
+	if pc.streams > 0 || !slices.Contains(p.conns, pc) {
+		p.mu.Unlock()
+		return
+	}
+
+	p.removeLocked(pc)
+	p.notifyLocked()
+	p.mu.Unlock()
+
+	closeConns([]*pooledConn{pc})
+}
+
+func (p *http2Pool) removeLocked(pc *pooledConn) {
+	p.conns = slices.DeleteFunc(p.conns, func(other *pooledConn) bool { return other == pc })
+}
+
+func (p *http2Pool) notifyLocked() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// closeIdleConnections closes the pooled connections carrying no request.
+func (p *http2Pool) closeIdleConnections() {
+	p.mu.Lock()
+
+	var idle []*pooledConn
+
+	p.conns = slices.DeleteFunc(p.conns, func(pc *pooledConn) bool {
+		if pc.streams > 0 {
+			return false
+		}
+
+		if pc.idleTimer != nil {
+			pc.idleTimer.Stop()
+		}
+
+		idle = append(idle, pc)
+
+		return true
+	})
+
+	p.notifyLocked()
+	p.mu.Unlock()
+
+	closeConns(idle)
+}
+
+// idle returns the number of pooled connections carrying no request.
+func (p *http2Pool) idle() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	idle := 0
+
+	for _, pc := range p.conns {
+		if pc.streams == 0 {
+			idle++
+		}
+	}
+
+	return idle
+}
+
+func closeConns(conns []*pooledConn) {
+	for _, pc := range conns {
+		_ = pc.cc.Close()
+	}
+}
+
+// rewindRequest returns req with its body reset for a retry, or err when
+// the body can't be sent again.
+func rewindRequest(req *http.Request, err error) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+
+	if req.GetBody == nil {
+		return nil, err
+	}
+
+	body, bodyErr := req.GetBody()
+
+	if bodyErr != nil {
+		return nil, bodyErr
+	}
+
+	rewound := *req
+	rewound.Body = body
+
+	return &rewound, nil
+}
@@ -0,0 +1,282 @@
+package http_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vimbing/fhttp/http2"
+)
+
+// startBlockingServer serves over TLS with HTTP/2, holding every request
+// until release is closed. It reports the requests in flight and the
+// connections it accepted.
+func startBlockingServer(t *testing.T, release chan struct{}) (url string, inFlight, maxInFlight, conns *atomic.Int64) {
+	inFlight, maxInFlight, conns = &atomic.Int64{}, &atomic.Int64{}, &atomic.Int64{}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+
+		for {
+			highest := maxInFlight.Load()
+
+			if current <= highest || maxInFlight.CompareAndSwap(highest, current) {
+				break
+			}
+		}
+
+		if r.URL.Path != "/warmup" {
+			<-release
+		}
+
+		w.Write([]byte(r.Proto))
+	}))
+
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return server.URL, inFlight, maxInFlight, conns
+}
+
+// waitFor polls condition until it holds or a second passed.
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(time.Second)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Condition was not met in time")
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func sendConcurrently(t *testing.T, client *Client, url string, n int) *sync.WaitGroup {
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			res, err := client.Get(url)
+
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+
+			if res.BodyString() != "HTTP/2.0" {
+				t.Errorf("Unexpected proto: %s", res.BodyString())
+			}
+		}()
+	}
+
+	return &wg
+}
+
+func TestPoolMaxConcurrentStreams(t *testing.T) {
+	release := make(chan struct{})
+	url, inFlight, _, conns := startBlockingServer(t, release)
+
+	client := MustNew(
+		WithInsecureSkipVerify(),
+		WithTlsProfile(chrome140Profile()),
+		WithPool(PoolSettings{MaxConcurrentStreams: 2}),
+	)
+
+	if _, err := client.Get(url + "/warmup"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	wg := sendConcurrently(t, client, url, 6)
+
+	waitFor(t, func() bool { return inFlight.Load() == 6 })
+
+	stats := client.PoolStats()
+
+	if len(stats) != 1 || stats[0].Protocol != "h2" || stats[0].Connections != 3 || stats[0].IdleConnections != 0 || stats[0].ActiveRequests != 6 {
+		t.Errorf("Unexpected stats while busy: %+v", stats)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if conns.Load() != 3 {
+		t.Errorf("Unexpected number of connections: %d", conns.Load())
+	}
+
+	stats = client.PoolStats()
+
+	if stats[0].Connections != 3 || stats[0].IdleConnections != 3 || stats[0].ActiveRequests != 0 || stats[0].TotalConnections != 3 || stats[0].TotalRequests != 7 {
+		t.Errorf("Unexpected stats when idle: %+v", stats)
+	}
+}
+
+func TestPoolMaxConnsPerHost(t *testing.T) {
+	release := make(chan struct{})
+	url, inFlight, maxInFlight, conns := startBlockingServer(t, release)
+
+	client := MustNew(
+		WithInsecureSkipVerify(),
+		WithTlsProfile(chrome140Profile()),
+		WithPool(PoolSettings{MaxConnsPerHost: 1, MaxConcurrentStreams: 2}),
+	)
+
+	if _, err := client.Get(url + "/warmup"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	wg := sendConcurrently(t, client, url, 5)
+
+	waitFor(t, func() bool { return inFlight.Load() == 2 })
+
+	// the remaining requests wait for a stream
+	time.Sleep(50 * time.Millisecond)
+
+	if stats := client.PoolStats(); stats[0].Connections != 1 || stats[0].ActiveRequests != 5 {
+		t.Errorf("Unexpected stats while busy: %+v", stats)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if maxInFlight.Load() != 2 || conns.Load() != 1 {
+		t.Errorf("Unexpected concurrency, streams: %d connections: %d", maxInFlight.Load(), conns.Load())
+	}
+}
+
+func TestPoolIdleConnTimeout(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+
+	url, _, _, conns := startBlockingServer(t, release)
+
+	client := MustNew(
+		WithInsecureSkipVerify(),
+		WithTlsProfile(chrome140Profile()),
+		WithPool(PoolSettings{IdleConnTimeout: 50 * time.Millisecond}),
+	)
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.Get(url); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		waitFor(t, func() bool { return client.PoolStats()[0].Connections == 0 })
+	}
+
+	if conns.Load() != 2 {
+		t.Errorf("Unexpected number of connections: %d", conns.Load())
+	}
+}
+
+func TestPoolDisableKeepAlivesHTTP1(t *testing.T) {
+	var conns atomic.Int64
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+
+	server.Start()
+	defer server.Close()
+
+	client := MustNew(WithPool(PoolSettings{DisableKeepAlives: true}))
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.Get(server.URL); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if conns.Load() != 3 {
+		t.Errorf("Unexpected number of connections: %d", conns.Load())
+	}
+
+	stats := client.PoolStats()
+
+	if len(stats) != 1 || stats[0].Protocol != "http/1.1" || stats[0].TotalConnections != 3 || stats[0].TotalRequests != 3 || stats[0].ActiveRequests != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestPoolNoResendAfterProcessing(t *testing.T) {
+	var hits atomic.Int64
+
+	type connKey struct{}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the connection dies while the second request is processed
+		if hits.Add(1) == 2 {
+			r.Context().Value(connKey{}).(net.Conn).Close()
+			return
+		}
+
+		w.Write([]byte(r.Proto))
+	}))
+
+	server.Config.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+		return context.WithValue(ctx, connKey{}, conn)
+	}
+
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	client := MustNew(WithInsecureSkipVerify(), WithTlsProfile(chrome140Profile()))
+
+	if _, err := client.Get(server.URL); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err := client.Get(server.URL); err == nil {
+		t.Errorf("Expected an error for the request the server processed")
+	}
+
+	if hits.Load() != 2 {
+		t.Errorf("Unexpected number of requests: %d", hits.Load())
+	}
+}
+
+func TestCanRetryHTTP2(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected bool
+	}{
+		{err: http2.ErrClientConnUnusable, expected: true},
+		{err: fmt.Errorf("dial: %w", http2.ErrClientConnGotGoAway), expected: true},
+		{err: http2.StreamError{StreamID: 1, Code: http2.ErrCodeRefusedStream}, expected: true},
+		{err: http2.StreamError{StreamID: 1, Code: http2.ErrCodeCancel}, expected: false},
+		{err: errors.New(http2.ErrClientConnUnusable.Error()), expected: false},
+		{err: io.ErrUnexpectedEOF, expected: false},
+	}
+
+	for _, testCase := range testCases {
+		if canRetryHTTP2(testCase.err) != testCase.expected {
+			t.Errorf("Unexpected retry decision for %v, expected: %t", testCase.err, testCase.expected)
+		}
+	}
+}
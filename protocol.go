@@ -0,0 +1,84 @@
+package http_client
+
+import (
+	"slices"
+
+	"github.com/vimbing/fhttp/http2"
+	tls "github.com/vimbing/utls"
+)
+
+// Protocol is the HTTP version a client or a request prefers.
+type Protocol int
+
+const (
+	// ProtocolAuto offers what the profile's hello offers and uses whatever
+	// the server picks.
+	ProtocolAuto Protocol = iota
+	// ProtocolHTTP1 only offers http/1.1, like Chrome with HTTP/2 disabled.
+	ProtocolHTTP1
+	// ProtocolHTTP2 only offers h2 and fails when the server does not pick
+	// it.
+	ProtocolHTTP2
+)
+
+const protocolHTTP1 = "http/1.1"
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolHTTP1:
+		return "http1"
+	case ProtocolHTTP2:
+		return "http2"
+	default:
+		return "auto"
+	}
+}
+
+// protocolKey carries the protocol preference of a request in its context.
+type protocolKey struct{}
+
+// alpn returns the ALPN list offered for p, nil keeps the profile's list.
+// custom is the list set through WithALPN, an explicit protocol wins over
+// it.
+func (p Protocol) alpn(custom []string) []string {
+	switch p {
+	case ProtocolHTTP1:
+		return []string{protocolHTTP1}
+	case ProtocolHTTP2:
+		return []string{http2.NextProtoTLS}
+	default:
+		return custom
+	}
+}
+
+// rewriteALPN replaces the ALPN list of extensions with alpn. Chrome only
+// sends application_settings for h2, so it is dropped once h2 is not
+// offered and narrowed to the offered protocols otherwise.
+func rewriteALPN(extensions []tls.TLSExtension, alpn []string) []tls.TLSExtension {
+	offered := func(protocols []string) []string {
+		return slices.DeleteFunc(slices.Clone(protocols), func(protocol string) bool {
+			return !slices.Contains(alpn, protocol)
+		})
+	}
+
+	rewritten := make([]tls.TLSExtension, 0, len(extensions))
+
+	for _, ext := range extensions {
+		switch ext := ext.(type) {
+		case *tls.ALPNExtension:
+			rewritten = append(rewritten, &tls.ALPNExtension{AlpnProtocols: slices.Clone(alpn)})
+		case *tls.ApplicationSettingsExtension:
+			if protocols := offered(ext.SupportedProtocols); len(protocols) > 0 {
+				rewritten = append(rewritten, &tls.ApplicationSettingsExtension{SupportedProtocols: protocols})
+			}
+		case *tls.ApplicationSettingsExtensionNew:
+			if protocols := offered(ext.SupportedProtocols); len(protocols) > 0 {
+				rewritten = append(rewritten, &tls.ApplicationSettingsExtensionNew{SupportedProtocols: protocols})
+			}
+		default:
+			rewritten = append(rewritten, ext)
+		}
+	}
+
+	return rewritten
+}
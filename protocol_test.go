@@ -0,0 +1,174 @@
+package http_client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// extensions carrying ALPS, in its old and new codepoint
+const (
+	extensionApplicationSettings    = 17513
+	extensionApplicationSettingsNew = 17613
+)
+
+func TestProtocolClientHello(t *testing.T) {
+	testCases := []struct {
+		name         string
+		options      []any
+		setup        func(*Request)
+		expectedALPN []string
+		expectedALPS bool
+	}{
+		{
+			name:         "auto",
+			expectedALPN: []string{"h2", "http/1.1"},
+			expectedALPS: true,
+		},
+		{
+			name:         "client http1",
+			options:      []any{WithProtocol(ProtocolHTTP1)},
+			expectedALPN: []string{"http/1.1"},
+		},
+		{
+			name:         "client http2",
+			options:      []any{WithProtocol(ProtocolHTTP2)},
+			expectedALPN: []string{"h2"},
+			expectedALPS: true,
+		},
+		{
+			name:         "request http1",
+			setup:        func(req *Request) { req.SetProtocol(ProtocolHTTP1) },
+			expectedALPN: []string{"http/1.1"},
+		},
+		{
+			name:         "request proto",
+			setup:        func(req *Request) { req.SetProto("HTTP/1.1", 1, 1) },
+			expectedALPN: []string{"http/1.1"},
+		},
+		{
+			name:         "custom alpn",
+			options:      []any{WithALPN("http/1.1", "h2")},
+			expectedALPN: []string{"http/1.1", "h2"},
+			expectedALPS: true,
+		},
+		{
+			name:         "request overrides custom alpn",
+			options:      []any{WithALPN("h2")},
+			setup:        func(req *Request) { req.SetProtocol(ProtocolHTTP1) },
+			expectedALPN: []string{"http/1.1"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			client := MustNew(append([]any{WithTlsProfile(chrome140Profile())}, testCase.options...)...)
+
+			hello := captureClientHelloFrom(t, func(addr string) {
+				req, err := client.NewRequest(fmt.Sprintf("https://%s/", addr), "GET", nil, nil)
+
+				if err != nil {
+					return
+				}
+
+				if testCase.setup != nil {
+					testCase.setup(req)
+				}
+
+				client.Do(req)
+			})
+
+			if !slices.Equal(hello.alpn, testCase.expectedALPN) {
+				t.Errorf("Unexpected ALPN, expected: %v got: %v", testCase.expectedALPN, hello.alpn)
+			}
+
+			hasALPS := slices.Contains(hello.extensions, extensionApplicationSettings) ||
+				slices.Contains(hello.extensions, extensionApplicationSettingsNew)
+
+			if hasALPS != testCase.expectedALPS {
+				t.Errorf("Unexpected application_settings presence, expected: %t", testCase.expectedALPS)
+			}
+		})
+	}
+}
+
+func TestProtocolNegotiation(t *testing.T) {
+	client := MustNew(
+		WithInsecureSkipVerify(),
+		WithTlsProfile(chrome140Profile()),
+	)
+
+	url := fmt.Sprintf("https://127.0.0.1:%d/ping", testTLSServerPort)
+
+	testCases := []struct {
+		name     string
+		setup    func(*Request)
+		expected string
+	}{
+		{name: "auto", expected: "h2"},
+		{name: "http1", setup: func(req *Request) { req.SetProtocol(ProtocolHTTP1) }, expected: "http/1.1"},
+		{name: "auto after http1", expected: "h2"},
+		{name: "http2", setup: func(req *Request) { req.SetProtocol(ProtocolHTTP2) }, expected: "h2"},
+	}
+
+	for _, testCase := range testCases {
+		req, err := client.NewRequest(url, "GET", nil, nil)
+
+		if err != nil {
+			t.Fatalf("Unexpected error while building request: %v", err)
+		}
+
+		if testCase.setup != nil {
+			testCase.setup(req)
+		}
+
+		res, err := client.Do(req)
+
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", testCase.name, err)
+		}
+
+		if protocol := res.ConnInfo().NegotiatedProtocol; protocol != testCase.expected {
+			t.Errorf("Unexpected protocol for %s, expected: %s got: %s", testCase.name, testCase.expected, protocol)
+		}
+	}
+}
+
+func TestProtocolHTTP2NotNegotiated(t *testing.T) {
+	certPEM, keyPEM := generateClientCertificate(t, "127.0.0.1")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+
+	if err != nil {
+		t.Fatalf("Unexpected error while loading certificate: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("Unexpected error while starting listener: %v", err)
+	}
+
+	// without NextProtos the server completes the handshake and picks no
+	// protocol
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.Listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+	server.Start()
+	defer server.Close()
+
+	client := MustNew(
+		WithInsecureSkipVerify(),
+		WithTlsProfile(chrome140Profile()),
+		WithProtocol(ProtocolHTTP2),
+	)
+
+	if _, err := client.Get(fmt.Sprintf("https://%s/", listener.Addr())); !errors.Is(err, ErrProtocolNotNegotiated) {
+		t.Fatalf("Expected ErrProtocolNotNegotiated, got: %v", err)
+	}
+}
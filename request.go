@@ -2,18 +2,44 @@ package http_client
 
 import (
 	"context"
+	"io"
 	"time"
 
 	fhttp "github.com/vimbing/fhttp"
 )
 
 func (r *Request) Build(timeout time.Duration) (context.Context, context.CancelFunc, error) {
+	return r.build(context.Background(), timeout)
+}
+
+func (r *Request) build(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc, error) {
 	ctx, cancel := context.WithTimeout(
-		context.Background(),
+		parent,
 		timeout,
 	)
 
-	req, err := fhttp.NewRequestWithContext(ctx, r.Method, r.Url, r.Body)
+	if r.tlsProfile != nil {
+		ctx = context.WithValue(ctx, tlsProfileKey{}, r.tlsProfile)
+	}
+
+	if protocol := r.requestedProtocol(); protocol != ProtocolAuto {
+		ctx = context.WithValue(ctx, protocolKey{}, protocol)
+	}
+
+	url, unixSocket := unixSocketURL(r.Url)
+
+	// a form sent before, by a retry, is sent again from the start
+	if body, ok := r.Body.(*multipartBody); ok && body.sent {
+		reopened, err := body.reopen()
+
+		if err != nil {
+			return ctx, cancel, err
+		}
+
+		r.Body = reopened
+	}
+
+	req, err := fhttp.NewRequestWithContext(ctx, r.Method, url, r.Body)
 
 	if err != nil {
 		return ctx, cancel, err
@@ -22,6 +48,24 @@ func (r *Request) Build(timeout time.Duration) (context.Context, context.CancelF
 	req.Header = r.Header
 	r.fhttpRequest = req
 
+	if body, ok := r.Body.(*multipartBody); ok {
+		body.sent = true
+		req.ContentLength = body.length
+		req.GetBody = func() (io.ReadCloser, error) {
+			reopened, err := body.reopen()
+
+			if err != nil {
+				return nil, err
+			}
+
+			return reopened, nil
+		}
+	}
+
+	if unixSocket {
+		req.Host = unixSocketHost
+	}
+
 	if r.host != nil {
 		r.fhttpRequest.Host = *r.host
 	}
@@ -39,8 +83,55 @@ func (r *Request) SetHost(host string) {
 	r.host = &host
 }
 
+// SetProxy sends this request through proxy, a URL like the ones passed
+// to WithProxyParsed, instead of the proxies of the client.
+func (r *Request) SetProxy(proxy string) {
+	r.proxy = &proxy
+}
+
+// SetProto sets the protocol version of the request. Major version 1 or 2
+// also negotiates that version, unless SetProtocol chose one.
 func (r *Request) SetProto(proto string, major int, minor int) {
 	r.proto = proto
 	r.protoMajor = major
 	r.protoMinor = minor
 }
+
+// SetProtocol overrides the protocol preference of the client for this
+// request and the redirects it follows.
+func (r *Request) SetProtocol(protocol Protocol) {
+	r.protocol = protocol
+}
+
+func (r *Request) requestedProtocol() Protocol {
+	if r.protocol != ProtocolAuto {
+		return r.protocol
+	}
+
+	switch r.protoMajor {
+	case 1:
+		return ProtocolHTTP1
+	case 2:
+		return ProtocolHTTP2
+	default:
+		return ProtocolAuto
+	}
+}
+
+// SetTimeout overrides the total timeout of the client for this request.
+func (r *Request) SetTimeout(timeout time.Duration) {
+	r.timeouts.Total = timeout
+}
+
+// SetTlsProfile makes this request, and the redirects it follows, use
+// profile instead of the client's or a host specific one. Requests only
+// share connections when their profiles have the same ID.
+func (r *Request) SetTlsProfile(profile TlsProfile) {
+	r.tlsProfile = &requestProfile{TlsProfile: profile, seq: requestProfileSeq.Add(1)}
+}
+
+// SetTimeouts overrides the phase timeouts of the client for this request,
+// zero fields keep the client values.
+func (r *Request) SetTimeouts(timeouts Timeouts) {
+	r.timeouts = timeouts
+}
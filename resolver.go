@@ -0,0 +1,368 @@
+package http_client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	http "github.com/vimbing/fhttp"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Resolver looks up the addresses the direct dialer connects to, proxy
+// hosts included. *net.Resolver satisfies it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// StaticResolver answers from a fixed host to address mapping, like curl's
+// --resolve. Hosts it does not know are passed to Fallback.
+type StaticResolver struct {
+	hosts    map[string][]net.IPAddr
+	Fallback Resolver
+}
+
+// NewStaticResolver pins every host in hosts to the given addresses. A nil
+// fallback means net.DefaultResolver.
+func NewStaticResolver(hosts map[string][]string, fallback Resolver) (*StaticResolver, error) {
+	r := &StaticResolver{
+		hosts:    make(map[string][]net.IPAddr, len(hosts)),
+		Fallback: fallback,
+	}
+
+	for host, addrs := range hosts {
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q for host %s", addr, host)
+			}
+
+			key := strings.ToLower(host)
+			r.hosts[key] = append(r.hosts[key], net.IPAddr{IP: ip})
+		}
+	}
+
+	return r, nil
+}
+
+func (r *StaticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if addrs, ok := r.hosts[strings.ToLower(host)]; ok {
+		return append([]net.IPAddr{}, addrs...), nil
+	}
+
+	if r.Fallback == nil {
+		return net.DefaultResolver.LookupIPAddr(ctx, host)
+	}
+
+	return r.Fallback.LookupIPAddr(ctx, host)
+}
+
+func (r *StaticResolver) bindClient(c *Client) {
+	bindResolverClient(r.Fallback, c)
+}
+
+// CachingResolver remembers successful lookups of Resolver for TTL.
+type CachingResolver struct {
+	Resolver Resolver
+	TTL      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedLookup
+}
+
+type cachedLookup struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+// NewCachingResolver caches lookups of resolver, a nil resolver means
+// net.DefaultResolver.
+func NewCachingResolver(resolver Resolver, ttl time.Duration) *CachingResolver {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	return &CachingResolver{
+		Resolver: resolver,
+		TTL:      ttl,
+		entries:  make(map[string]cachedLookup),
+	}
+}
+
+func (r *CachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	key := strings.ToLower(host)
+
+	r.mu.Lock()
+	entry, ok := r.entries[key]
+	r.mu.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return append([]net.IPAddr{}, entry.addrs...), nil
+	}
+
+	addrs, err := r.Resolver.LookupIPAddr(ctx, host)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.entries[key] = cachedLookup{addrs: addrs, expires: time.Now().Add(r.TTL)}
+	r.mu.Unlock()
+
+	return append([]net.IPAddr{}, addrs...), nil
+}
+
+// Flush drops every cached lookup.
+func (r *CachingResolver) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries = make(map[string]cachedLookup)
+}
+
+func (r *CachingResolver) bindClient(c *Client) {
+	bindResolverClient(r.Resolver, c)
+}
+
+// DoHResolver resolves through DNS-over-HTTPS (RFC 8484). Queries are sent
+// with the TLS profile of the Client, so they look like the rest of its
+// traffic, but over a transport of their own that connects directly and
+// skips the middleware and status validation of the client.
+type DoHResolver struct {
+	Endpoint string
+
+	// Bootstrap resolves the host of Endpoint itself, nil means
+	// net.DefaultResolver.
+	Bootstrap Resolver
+
+	mu          sync.Mutex
+	client      *Client
+	queryClient *Client
+	echConfigs  map[string]cachedECHConfigList
+}
+
+// NewDoHResolver queries endpoint, e.g. https://1.1.1.1/dns-query, using
+// client. When client is nil the resolver uses the client it gets passed to
+// with WithResolver.
+func NewDoHResolver(endpoint string, client *Client) *DoHResolver {
+	return &DoHResolver{
+		Endpoint: endpoint,
+		client:   client,
+	}
+}
+
+func (r *DoHResolver) bindClient(c *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.client == nil {
+		r.client = c
+	}
+}
+
+func (r *DoHResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	endpoint, err := url.Parse(r.Endpoint)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.EqualFold(endpoint.Hostname(), host) {
+		if r.Bootstrap == nil {
+			return net.DefaultResolver.LookupIPAddr(ctx, host)
+		}
+
+		return r.Bootstrap.LookupIPAddr(ctx, host)
+	}
+
+	type queryResult struct {
+		answers []dnsmessage.Resource
+		err     error
+	}
+
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	results := make([]queryResult, len(types))
+
+	var wg sync.WaitGroup
+
+	for i, qtype := range types {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			msg, err := r.query(ctx, host, qtype)
+
+			if err != nil {
+				results[i] = queryResult{err: err}
+				return
+			}
+
+			results[i] = queryResult{answers: msg.Answers}
+		}()
+	}
+
+	wg.Wait()
+
+	var addrs []net.IPAddr
+
+	for _, result := range results {
+		if result.err != nil {
+			return nil, result.err
+		}
+
+		for _, answer := range result.answers {
+			switch body := answer.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, net.IPAddr{IP: net.IP(body.A[:])})
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, net.IPAddr{IP: net.IP(body.AAAA[:])})
+			}
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	return addrs, nil
+}
+
+// query sends a single question and returns the response.
+func (r *DoHResolver) query(ctx context.Context, host string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	client, err := r.internalClient()
+
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := dnsmessage.NewName(dnsName(host))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// RFC 8484 asks for a zero ID so responses stay cacheable.
+	query, err := (&dnsmessage.Message{
+		Header: dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}).Pack()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The lookup runs on behalf of another request, it has to honor that
+	// request's deadline but must not report into its execution.
+	res, err := client.SendContext(
+		detachedValuesContext{ctx},
+		"POST",
+		r.Endpoint,
+		WithHeader(http.Header{
+			"accept":       {"application/dns-message"},
+			"content-type": {"application/dns-message"},
+		}),
+		WithBody(bytes.NewReader(query)),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode() != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrDoHQueryFailed, res.Status())
+	}
+
+	var msg dnsmessage.Message
+
+	if err := msg.Unpack(res.Body); err != nil {
+		return nil, err
+	}
+
+	if msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError {
+		return nil, fmt.Errorf("%w: %s", ErrDoHQueryFailed, msg.RCode)
+	}
+
+	return &msg, nil
+}
+
+// internalClient returns the client queries are sent with, built once from
+// the configuration of the bound client. Proxies, custom dialers and the
+// middleware of the bound client could all need a lookup of their own, so
+// the internal client has none of them.
+func (r *DoHResolver) internalClient() (*Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.queryClient != nil {
+		return r.queryClient, nil
+	}
+
+	if r.client == nil {
+		return nil, fmt.Errorf("%w: resolver is not bound to a client", ErrDoHQueryFailed)
+	}
+
+	cfg := r.client.snapshot().cfg.clone()
+
+	cfg.proxies = []string{}
+	cfg.forceRotation = false
+	cfg.dialer = nil
+	cfg.resolver = r.Bootstrap
+	cfg.echFromDNS = false
+	cfg.jar = nil
+	cfg.hooks = Hooks{}
+	cfg.retry = &Retry{}
+	cfg.requestMiddleware = nil
+	cfg.responseMiddleware = nil
+	cfg.responseErrorMiddleware = nil
+	cfg.statusValidationFunc = nil
+
+	client := &Client{cfg: cfg}
+
+	if err := client.reinitFhttpClient(); err != nil {
+		return nil, err
+	}
+
+	r.queryClient = client
+
+	return client, nil
+}
+
+// resolverClientBinder is implemented by resolvers that send their queries
+// through a Client, or that wrap such a resolver.
+type resolverClientBinder interface {
+	bindClient(c *Client)
+}
+
+func bindResolverClient(r Resolver, c *Client) {
+	if binder, ok := r.(resolverClientBinder); ok {
+		binder.bindClient(c)
+	}
+}
+
+func dnsName(host string) string {
+	if strings.HasSuffix(host, ".") {
+		return host
+	}
+
+	return host + "."
+}
+
+// detachedValuesContext keeps the cancellation of a context but hides its
+// values, so a nested request does not inherit the caller's execution.
+type detachedValuesContext struct {
+	context.Context
+}
+
+func (detachedValuesContext) Value(key any) any {
+	return nil
+}
@@ -0,0 +1,179 @@
+package http_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingResolver struct {
+	lookups atomic.Int64
+}
+
+func (r *countingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.lookups.Add(1)
+	return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+}
+
+func TestStaticResolver(t *testing.T) {
+	resolver, err := NewStaticResolver(map[string][]string{
+		"pinned.test": {"127.0.0.1"},
+	}, nil)
+
+	if err != nil {
+		t.Fatalf("Unexpected error while creating resolver: %v", err)
+	}
+
+	client := MustNew(
+		WithResolver(resolver),
+	)
+
+	res, err := client.Get(fmt.Sprintf("http://pinned.test:%d/ping", testServerPort))
+
+	if err != nil {
+		t.Fatalf("Unexpected error while pinging pinned host: %v", err)
+	}
+
+	if res.BodyString() != "pong" {
+		t.Errorf("Unexpected body from test server: %s", res.BodyString())
+	}
+
+	if _, err := NewStaticResolver(map[string][]string{"bad.test": {"not-an-ip"}}, nil); err == nil {
+		t.Errorf("Expected error for invalid address")
+	}
+}
+
+func TestCachingResolver(t *testing.T) {
+	upstream := &countingResolver{}
+	resolver := NewCachingResolver(upstream, time.Minute)
+
+	client := MustNew(
+		WithResolver(resolver),
+	)
+
+	for i := 0; i < 5; i++ {
+		// fresh transport every time, so each request has to dial
+		client.RotateProxy()
+
+		if _, err := client.Get(fmt.Sprintf("http://cached.test:%d/ping", testServerPort)); err != nil {
+			t.Fatalf("Unexpected error while pinging cached host: %v", err)
+		}
+	}
+
+	if lookups := upstream.lookups.Load(); lookups != 1 {
+		t.Errorf("Unexpected number of upstream lookups, expected: 1 got: %d", lookups)
+	}
+
+	resolver.Flush()
+
+	client.RotateProxy()
+
+	if _, err := client.Get(fmt.Sprintf("http://cached.test:%d/ping", testServerPort)); err != nil {
+		t.Fatalf("Unexpected error while pinging cached host: %v", err)
+	}
+
+	if lookups := upstream.lookups.Load(); lookups != 2 {
+		t.Errorf("Unexpected number of upstream lookups after flush, expected: 2 got: %d", lookups)
+	}
+}
+
+func TestDoHResolver(t *testing.T) {
+	queriesBefore := testServerDNSQueries.Load()
+
+	client := MustNew(
+		WithResolver(NewDoHResolver(fmt.Sprintf("http://127.0.0.1:%d/dns-query", testServerPort), nil)),
+	)
+
+	res, err := client.Get(fmt.Sprintf("http://doh.test:%d/ping", testServerPort))
+
+	if err != nil {
+		t.Fatalf("Unexpected error while pinging host resolved over DoH: %v", err)
+	}
+
+	if res.BodyString() != "pong" {
+		t.Errorf("Unexpected body from test server: %s", res.BodyString())
+	}
+
+	if queries := testServerDNSQueries.Load() - queriesBefore; queries != 2 {
+		t.Errorf("Unexpected number of DoH queries, expected: 2 got: %d", queries)
+	}
+}
+
+func TestDoHResolverBypassesClient(t *testing.T) {
+	queriesBefore := testServerDNSQueries.Load()
+
+	_, proxyPort, _ := net.SplitHostPort(startConnectProxy(t))
+	var requests atomic.Int64
+
+	client := MustNew(
+		WithResolver(NewDoHResolver(fmt.Sprintf("http://127.0.0.1:%d/dns-query", testServerPort), nil)),
+		WithRequestMiddleware(func(req *Request) error {
+			requests.Add(1)
+			return nil
+		}),
+	)
+
+	if _, err := client.Get(fmt.Sprintf("http://doh.test:%d/ping", testServerPort)); err != nil {
+		t.Fatalf("Unexpected error while pinging host resolved over DoH: %v", err)
+	}
+
+	if count := requests.Load(); count != 1 {
+		t.Errorf("DoH queries ran the request middleware, requests: %d", count)
+	}
+
+	// the proxy host is resolved over DoH too, the queries don't go
+	// through the proxy they are finding
+	client.ChangeProxyParsed(fmt.Sprintf("http://proxy.doh.test:%s", proxyPort))
+
+	res, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/ping", testServerPort))
+
+	if err != nil {
+		t.Fatalf("Unexpected error while pinging test server through proxy: %v", err)
+	}
+
+	if res.BodyString() != "pong" {
+		t.Errorf("Unexpected body from test server: %s", res.BodyString())
+	}
+
+	if queries := testServerDNSQueries.Load() - queriesBefore; queries != 4 {
+		t.Errorf("Unexpected number of DoH queries, expected: 4 got: %d", queries)
+	}
+}
+
+func TestUnboundDoHResolver(t *testing.T) {
+	resolver := NewDoHResolver(fmt.Sprintf("http://127.0.0.1:%d/dns-query", testServerPort), nil)
+
+	if _, err := resolver.LookupIPAddr(context.Background(), "doh.test"); err == nil {
+		t.Errorf("Expected error from resolver without client")
+	}
+}
+
+type stallingResolver struct{}
+
+func (stallingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestResolverDNSTimeout(t *testing.T) {
+	client := MustNew(
+		WithResolver(stallingResolver{}),
+		WithTimeouts(Timeouts{DNS: 100 * time.Millisecond}),
+	)
+
+	_, err := client.Get(fmt.Sprintf("http://stalling.test:%d/ping", testServerPort))
+
+	var timeoutErr *TimeoutError
+
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("Expected *TimeoutError, got: %v", err)
+	}
+
+	if timeoutErr.Phase != PhaseDNS {
+		t.Errorf("Unexpected timeout phase, expected: %s got: %s", PhaseDNS, timeoutErr.Phase)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"strconv"
+	"strings"
 
 	fhttp "github.com/vimbing/fhttp"
 )
@@ -53,6 +55,38 @@ func (r *Response) Headers() fhttp.Header {
 	return r.fhttpResponse.Header
 }
 
+// ContentLength returns the Content-Length sent by the server, also for
+// HEAD requests and other responses without a body, or -1 when unknown.
+func (r *Response) ContentLength() int64 {
+	if value := r.fhttpResponse.Header.Get("content-length"); len(value) > 0 {
+		if length, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err == nil && length >= 0 {
+			return length
+		}
+	}
+
+	if r.fhttpResponse.ContentLength > 0 {
+		return r.fhttpResponse.ContentLength
+	}
+
+	return -1
+}
+
+// Allow returns the methods listed in the Allow headers, as answered to
+// OPTIONS requests and with 405 responses.
+func (r *Response) Allow() []string {
+	var methods []string
+
+	for _, value := range r.fhttpResponse.Header.Values("allow") {
+		for _, method := range strings.Split(value, ",") {
+			if method = strings.TrimSpace(method); len(method) > 0 {
+				methods = append(methods, method)
+			}
+		}
+	}
+
+	return methods
+}
+
 func (r *Response) Url() url.URL {
 	return *r.fhttpResponse.Request.URL
 }
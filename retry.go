@@ -1,18 +1,28 @@
 package http_client
 
 import (
+	"context"
+	"errors"
 	"slices"
 	"time"
 )
 
 func (r *Retry) Retry(f doFunc, req *Request) (*Response, error) {
+	return r.retryContext(context.Background(), f, req)
+}
+
+// retryContext is Retry stopping once ctx is done, it returns the error of
+// ctx rather than ErrRetryExceed.
+func (r *Retry) retryContext(ctx context.Context, f doFunc, req *Request) (*Response, error) {
 	if r.Max == 0 {
 		return f(req)
 	}
 
 	for i := 0; i < r.Max; i++ {
 		if i != 0 {
-			time.Sleep(r.Delay)
+			if err := sleepContext(ctx, r.Delay); err != nil {
+				return nil, err
+			}
 		}
 
 		res, err := f(req)
@@ -25,14 +35,40 @@ func (r *Retry) Retry(f doFunc, req *Request) (*Response, error) {
 			r.OnError(err)
 		}
 
-		if slices.Contains(r.EndingErrors, err) {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			if errors.Is(err, ctxErr) {
+				return res, err
+			}
+
+			return res, ctxErr
+		}
+
+		if slices.ContainsFunc(r.EndingErrors, matchesErr(err)) {
 			return res, err
 		}
 
-		if slices.Contains(r.IgnoredErrors, err) {
+		if slices.ContainsFunc(r.IgnoredErrors, matchesErr(err)) {
 			i--
 		}
 	}
 
 	return nil, ErrRetryExceed
 }
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func matchesErr(err error) func(error) bool {
+	return func(target error) bool {
+		return errors.Is(err, target)
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"maps"
 	"net"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	http "github.com/vimbing/fhttp"
 
@@ -24,49 +27,165 @@ type roundTripper struct {
 	insecureSkipVerify bool
 	clientHelloId      tls.ClientHelloID
 	clientHelloSpec    *tls.ClientHelloSpec
+	helloShaping       helloShaping
+	tlsOptions         tlsOptions
+	protocol           Protocol
+	h2c                H2CMode
 
 	cachedConnections map[string]net.Conn
 	cachedTransports  map[string]http.RoundTripper
+	discoveries       map[string]*discovery
 
 	dialer proxy.ContextDialer
 
 	http2Settings      map[http2.SettingID]uint32
 	http2SettingsOrder []http2.SettingID
+	http2Fingerprint   http2Fingerprint
+	pseudoHeaderOrder  []string
 	disablePush        bool
+
+	timeouts Timeouts
+	pool     PoolSettings
+
+	statsMu sync.Mutex
+	stats   map[string]*poolCounters
+
+	// closed is set once rt is dropped
+	closed atomic.Bool
 }
 
 func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	addr := rt.getDialTLSAddr(req)
 
-	rt.Lock()
-	if _, ok := rt.cachedTransports[addr]; !ok {
-		rt.Unlock()
-		if err := rt.getTransport(req, addr); err != nil {
-			return nil, err
+	transport, err := rt.transport(req, addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rt.counters(addr, func(c *poolCounters) {
+		c.activeRequests++
+		c.totalRequests++
+	})
+
+	release := func() {
+		rt.counters(addr, func(c *poolCounters) { c.activeRequests-- })
+
+		// a request outliving rt left its connection open
+		if rt.closed.Load() {
+			rt.close()
 		}
-	} else {
+	}
+
+	res, err := transport.RoundTrip(req)
+
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	releaseOnBodyClose(res, release)
+
+	return res, nil
+}
+
+// discovery is an ongoing getTransport call, err and canceled are set once
+// done is closed.
+type discovery struct {
+	done chan struct{}
+	err  error
+
+	// canceled reports that the probing request ended before the probe did
+	canceled bool
+}
+
+// transport returns the transport for addr, discovering it first. Only one
+// request probes an address at a time, concurrent ones wait for its
+// result, so a cold host sees a single handshake.
+func (rt *roundTripper) transport(req *http.Request, addr string) (http.RoundTripper, error) {
+	ctx := req.Context()
+
+	for {
+		rt.Lock()
+
+		if transport, ok := rt.cachedTransports[addr]; ok {
+			rt.Unlock()
+			return transport, nil
+		}
+
+		if call, ok := rt.discoveries[addr]; ok {
+			rt.Unlock()
+
+			select {
+			case <-call.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+
+			// a probe cut short by its own request says nothing about
+			// the host, probe again
+			if call.err != nil && !call.canceled {
+				return nil, call.err
+			}
+
+			continue
+		}
+
+		call := &discovery{done: make(chan struct{})}
+		rt.discoveries[addr] = call
 		rt.Unlock()
+
+		call.err = rt.getTransport(req, addr)
+		call.canceled = ctx.Err() != nil
+
+		rt.Lock()
+		delete(rt.discoveries, addr)
+		rt.Unlock()
+
+		close(call.done)
+
+		if call.err != nil {
+			return nil, call.err
+		}
 	}
+}
+
+// close closes the connections of rt that carry no request, the others once
+// their request is done. It is called once rt is dropped and nothing else
+// would.
+func (rt *roundTripper) close() {
+	rt.closed.Store(true)
 
 	rt.Lock()
-	transport := rt.cachedTransports[addr]
+	transports := slices.Collect(maps.Values(rt.cachedTransports))
+	conns := slices.Collect(maps.Values(rt.cachedConnections))
+	clear(rt.cachedConnections)
 	rt.Unlock()
-	return transport.RoundTrip(req)
+
+	for _, transport := range transports {
+		switch transport := transport.(type) {
+		case *http.Transport:
+			transport.CloseIdleConnections()
+		case *http2Pool:
+			transport.closeIdleConnections()
+		}
+	}
+
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
 }
 
 func (rt *roundTripper) getTransport(req *http.Request, addr string) error {
 	switch strings.ToLower(req.URL.Scheme) {
 	case "http":
-		rt.Lock()
-		rt.cachedTransports[addr] = &http.Transport{DialContext: rt.dialer.DialContext}
-		rt.Unlock()
-		return nil
+		return rt.getCleartextTransport(req, addr)
 	case "https":
 	default:
 		return fmt.Errorf("invalid URL scheme: [%v]", req.URL.Scheme)
 	}
 
-	_, err := rt.dialTLS(context.Background(), "tcp", addr)
+	_, err := rt.dialTLS(req.Context(), "tcp", addr)
 	switch err {
 	case errProtocolNegotiated:
 	case nil:
@@ -79,95 +198,170 @@ func (rt *roundTripper) getTransport(req *http.Request, addr string) error {
 	return nil
 }
 
-func (rt *roundTripper) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
-	rt.Lock()
-	defer rt.Unlock()
+func (rt *roundTripper) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := rt.dialer.DialContext(ctx, network, addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	enterPhase(ctx, PhaseResponseHeaders)
 
+	return rt.trackConn(addr, conn), nil
+}
+
+// handshake dials addr and runs the TLS handshake with host, offering
+// echConfigList.
+func (rt *roundTripper) handshake(ctx context.Context, network, addr, host string, echConfigList []byte) (*tls.UConn, error) {
+	rawConn, err := rt.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := rt.newTLSConn(rawConn, host, echConfigList)
+
+	if err != nil {
+		_ = rawConn.Close()
+		return nil, err
+	}
+
+	handshakeCtx, cancel := phaseContext(ctx, PhaseTLSHandshake, contextTimeouts(ctx, rt.timeouts).TLSHandshake)
+	defer cancel()
+
+	if err = conn.HandshakeContext(handshakeCtx); err != nil {
+		_ = conn.Close()
+
+		var rejection *tls.ECHRejectionError
+
+		if errors.As(err, &rejection) {
+			if verifyErr := rt.verifyECHRejection(conn.ConnectionState()); verifyErr != nil {
+				err = verifyErr
+			}
+		}
+
+		err = phaseErr(handshakeCtx, err)
+		tlsHandshakeDone(ctx, tls.ConnectionState{}, err)
+
+		return nil, err
+	}
+
+	tlsHandshakeDone(ctx, conn.ConnectionState(), nil)
+
+	return conn, nil
+}
+
+func (rt *roundTripper) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
 	// If we have the connection from when we determined the HTTPS
 	// cachedTransports to use, return that.
+	rt.Lock()
 	if conn := rt.cachedConnections[addr]; conn != nil {
 		delete(rt.cachedConnections, addr)
+		rt.Unlock()
 		return conn, nil
 	}
+	rt.Unlock()
 
-	rawConn, err := rt.dialer.DialContext(ctx, network, addr)
+	// The lock is not held while dialing, resolvers like DoHResolver send
+	// requests through this very round tripper.
+
+	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		return nil, err
+		host = addr
 	}
 
-	var host string
-	if host, _, err = net.SplitHostPort(addr); err != nil {
-		host = addr
+	echConfigList, err := rt.tlsOptions.echConfigList(ctx, host, contextTimeouts(ctx, rt.timeouts))
+	if err != nil {
+		return nil, err
 	}
 
-	conn := tls.UClient(rawConn, &tls.Config{
-		ServerName:         host,
-		InsecureSkipVerify: rt.insecureSkipVerify,
-	},
-		rt.clientHelloId,
-	)
+	conn, err := rt.handshake(ctx, network, addr, host, echConfigList)
 
-	if rt.clientHelloSpec != nil {
-		if err := conn.ApplyPreset(rt.clientHelloSpec); err != nil {
-			_ = conn.Close()
-			return nil, err
-		}
+	var rejection *tls.ECHRejectionError
+
+	// The configs were stale or the server dropped ECH. Like browsers, try
+	// once more with the configs the server sent back, or without ECH when
+	// it sent none.
+	if len(echConfigList) > 0 && errors.As(err, &rejection) {
+		conn, err = rt.handshake(ctx, network, addr, host, rejection.RetryConfigList)
 	}
 
 	if err != nil {
-		_ = conn.Close()
 		return nil, err
 	}
 
-	if err = conn.Handshake(); err != nil {
+	if err = rt.tlsOptions.verifyPins(host, conn.ConnectionState()); err != nil {
 		_ = conn.Close()
 		return nil, err
 	}
 
-	if rt.cachedTransports[addr] != nil {
-		return conn, nil
+	negotiated := conn.ConnectionState().NegotiatedProtocol
+
+	if rt.protocol == ProtocolHTTP2 && negotiated != http2.NextProtoTLS {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%w: server picked %q instead of h2", ErrProtocolNotNegotiated, negotiated)
 	}
 
-	// No http.Transport constructed yet, create one based on the results
-	// of ALPN.
-	switch conn.ConnectionState().NegotiatedProtocol {
+	enterPhase(ctx, PhaseResponseHeaders)
 
-	case http2.NextProtoTLS:
-		t2 := http2.Transport{DialTLS: rt.dialTLSHTTP2}
+	tracked := rt.trackConn(addr, conn)
 
-		if len(rt.http2Settings) == 0 && len(rt.http2SettingsOrder) == 0 {
-			t2.HeaderTableSize = 65536
+	rt.Lock()
+	defer rt.Unlock()
 
-			t2.Settings = []http2.Setting{
-				{ID: http2.SettingMaxConcurrentStreams, Val: 1000},
-				{ID: http2.SettingMaxHeaderListSize, Val: 262144},
-			}
+	if rt.cachedTransports[addr] != nil {
+		return tracked, nil
+	}
 
-			t2.InitialWindowSize = 6291456
-		} else {
-			for _, settingId := range rt.http2SettingsOrder {
-				t2.Settings = append(t2.Settings, http2.Setting{
-					ID:  settingId,
-					Val: rt.http2Settings[settingId],
-				})
-			}
-		}
+	// No http.Transport constructed yet, create one based on the results
+	// of ALPN.
+	switch negotiated {
 
-		rt.cachedTransports[addr] = &t2
+	case http2.NextProtoTLS:
+		rt.cachedTransports[addr] = rt.newHTTP2Pool(rt.newHTTP2Transport(), func(ctx context.Context) (net.Conn, error) {
+			return rt.dialTLS(ctx, "tcp", addr)
+		})
 	default:
 		// Assume the remote peer is speaking HTTP 1.x + TLS.
-		rt.cachedTransports[addr] = &http.Transport{DialTLSContext: rt.dialTLS}
+		t1 := rt.newHTTP1Transport()
+		t1.DialTLSContext = rt.dialTLS
+
+		rt.cachedTransports[addr] = t1
 	}
 
 	// Stash the connection just established for use servicing the
 	// actual request (should be near-immediate).
-	rt.cachedConnections[addr] = conn
+	rt.cachedConnections[addr] = tracked
 
 	return nil, errProtocolNegotiated
 }
 
-func (rt *roundTripper) dialTLSHTTP2(network, addr string, _ *tls.Config) (net.Conn, error) {
-	return rt.dialTLS(context.Background(), network, addr)
+// newHTTP2Transport returns an HTTP/2 transport carrying the profile's
+// SETTINGS and the rest of its HTTP/2 fingerprint, its connections are
+// opened by an http2Pool.
+func (rt *roundTripper) newHTTP2Transport() *http2.Transport {
+	t2 := &http2.Transport{}
+
+	if len(rt.http2Settings) == 0 && len(rt.http2SettingsOrder) == 0 {
+		t2.HeaderTableSize = 65536
+
+		t2.Settings = []http2.Setting{
+			{ID: http2.SettingMaxConcurrentStreams, Val: 1000},
+			{ID: http2.SettingMaxHeaderListSize, Val: 262144},
+		}
+
+		t2.InitialWindowSize = 6291456
+	} else {
+		for _, settingId := range rt.http2SettingsOrder {
+			t2.Settings = append(t2.Settings, http2.Setting{
+				ID:  settingId,
+				Val: rt.http2Settings[settingId],
+			})
+		}
+	}
+
+	rt.http2Fingerprint.apply(t2)
+
+	return t2
 }
 
 func (rt *roundTripper) getDialTLSAddr(req *http.Request) string {
@@ -175,25 +369,49 @@ func (rt *roundTripper) getDialTLSAddr(req *http.Request) string {
 	if err == nil {
 		return net.JoinHostPort(host, port)
 	}
-	return net.JoinHostPort(req.URL.Host, "443") // we can assume port is 443 at this point
+	if strings.EqualFold(req.URL.Scheme, "http") {
+		return net.JoinHostPort(req.URL.Host, "80")
+	}
+
+	return net.JoinHostPort(req.URL.Host, "443")
 }
 
 type roundTripperSettings struct {
 	clientHello        tls.ClientHelloID
+	clientHelloSpec    *tls.ClientHelloSpec
+	helloShaping       helloShaping
+	tlsOptions         tlsOptions
+	protocol           Protocol
+	h2c                H2CMode
 	insecureSkipVerify bool
 	dialer             proxy.ContextDialer
 	http2Settings      map[http2.SettingID]uint32
 	http2SettingsOrder []http2.SettingID
+	http2Fingerprint   http2Fingerprint
+	pseudoHeaderOrder  []string
+	timeouts           Timeouts
+	pool               PoolSettings
 }
 
-func newRoundTripper(settings roundTripperSettings) http.RoundTripper {
+func newRoundTripper(settings roundTripperSettings) *roundTripper {
 	return &roundTripper{
 		dialer:             settings.dialer,
 		insecureSkipVerify: settings.insecureSkipVerify,
 		clientHelloId:      settings.clientHello,
+		clientHelloSpec:    settings.clientHelloSpec,
+		helloShaping:       settings.helloShaping,
+		tlsOptions:         settings.tlsOptions,
+		protocol:           settings.protocol,
+		h2c:                settings.h2c,
 		cachedTransports:   make(map[string]http.RoundTripper),
 		cachedConnections:  make(map[string]net.Conn),
+		discoveries:        make(map[string]*discovery),
 		http2Settings:      settings.http2Settings,
 		http2SettingsOrder: settings.http2SettingsOrder,
+		http2Fingerprint:   settings.http2Fingerprint,
+		pseudoHeaderOrder:  settings.pseudoHeaderOrder,
+		timeouts:           settings.timeouts,
+		pool:               settings.pool,
+		stats:              make(map[string]*poolCounters),
 	}
 }
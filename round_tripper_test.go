@@ -0,0 +1,83 @@
+package http_client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTransportDiscoverySingleFlight(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+
+	url, _, _, conns := startBlockingServer(t, release)
+
+	client := MustNew(
+		WithInsecureSkipVerify(),
+		WithTlsProfile(chrome140Profile()),
+	)
+
+	sendConcurrently(t, client, url, 50).Wait()
+
+	if conns.Load() != 1 {
+		t.Errorf("Unexpected number of handshakes: %d", conns.Load())
+	}
+
+	transport := client.snapshot().fhttpClient.Transport.(*profileRoundTripper)
+
+	for _, rt := range transport.roundTrippers.values() {
+		if len(rt.cachedConnections) != 0 || len(rt.discoveries) != 0 {
+			t.Errorf("Stray state left, connections: %d discoveries: %d", len(rt.cachedConnections), len(rt.discoveries))
+		}
+	}
+}
+
+// blockingDialer counts dials and fails each of them once release is
+// closed.
+type blockingDialer struct {
+	dials   atomic.Int64
+	release chan struct{}
+}
+
+func (d *blockingDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *blockingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.dials.Add(1)
+	<-d.release
+
+	return nil, errors.New("connection refused")
+}
+
+func TestTransportDiscoverySharesErrors(t *testing.T) {
+	dialer := &blockingDialer{release: make(chan struct{})}
+	client := MustNew(WithDialer(dialer))
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if _, err := client.Get("https://127.0.0.1:1/"); err == nil {
+				t.Errorf("Expected an error")
+			}
+		}()
+	}
+
+	// let every request queue up behind the first probe
+	time.Sleep(50 * time.Millisecond)
+	close(dialer.release)
+	wg.Wait()
+
+	if dialer.dials.Load() != 1 {
+		t.Errorf("Unexpected number of dials: %d", dialer.dials.Load())
+	}
+}
@@ -0,0 +1,214 @@
+package http_client
+
+import (
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var testServerPort int
+
+// testTLSServerPort serves the same routes as testServerPort over TLS with
+// HTTP/2 enabled, using a self signed certificate.
+var testTLSServerPort int
+
+// testTLSServerCert is the certificate presented on testTLSServerPort.
+var testTLSServerCert *x509.Certificate
+
+// testServerAborted counts handlers that observed the client going away
+// before they finished writing the response.
+var testServerAborted atomic.Int64
+
+// testServerDNSQueries counts queries answered by the DNS-over-HTTPS stub,
+// which resolves every A question to 127.0.0.1.
+var testServerDNSQueries atomic.Int64
+
+// testServerECHConfigList is published in the HTTPS records of the
+// DNS-over-HTTPS stub when set.
+var testServerECHConfigList atomic.Pointer[[]byte]
+
+func testServerMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pong"))
+	})
+
+	mux.HandleFunc("/remote-addr", func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		w.Write([]byte(host))
+	})
+
+	mux.HandleFunc("/tls-resumed", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strconv.FormatBool(r.TLS != nil && r.TLS.DidResume)))
+	})
+
+	mux.HandleFunc("/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		io.Copy(w, r.Body)
+	})
+
+	mux.HandleFunc("/timeout", func(w http.ResponseWriter, r *http.Request) {
+		timeoutMs, _ := strconv.Atoi(r.URL.Query().Get("timeoutMs"))
+
+		select {
+		case <-time.After(time.Duration(timeoutMs) * time.Millisecond):
+			w.Write([]byte("ok"))
+		case <-r.Context().Done():
+			testServerAborted.Add(1)
+		}
+	})
+
+	mux.HandleFunc("/slow-body", func(w http.ResponseWriter, r *http.Request) {
+		chunks, _ := strconv.Atoi(r.URL.Query().Get("chunks"))
+		delayMs, _ := strconv.Atoi(r.URL.Query().Get("delayMs"))
+
+		w.WriteHeader(http.StatusOK)
+
+		for i := 0; i < chunks; i++ {
+			if _, err := w.Write([]byte("chunk")); err != nil {
+				testServerAborted.Add(1)
+				return
+			}
+
+			w.(http.Flusher).Flush()
+
+			select {
+			case <-time.After(time.Duration(delayMs) * time.Millisecond):
+			case <-r.Context().Done():
+				testServerAborted.Add(1)
+				return
+			}
+		}
+	})
+
+	mux.HandleFunc("/dns-query", func(w http.ResponseWriter, r *http.Request) {
+		testServerDNSQueries.Add(1)
+
+		query, _ := io.ReadAll(r.Body)
+
+		var msg dnsmessage.Message
+
+		if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		msg.Header.Response = true
+
+		if configList := testServerECHConfigList.Load(); configList != nil && msg.Questions[0].Type == typeHTTPS {
+			// priority 1, target "." and the ech parameter
+			data := []byte{0, 1, 0, 0, svcParamECH, byte(len(*configList) >> 8), byte(len(*configList))}
+
+			msg.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{
+					Name:  msg.Questions[0].Name,
+					Type:  typeHTTPS,
+					Class: dnsmessage.ClassINET,
+					TTL:   60,
+				},
+				Body: &dnsmessage.UnknownResource{Type: typeHTTPS, Data: append(data, *configList...)},
+			}}
+		}
+
+		if msg.Questions[0].Type == dnsmessage.TypeA {
+			msg.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{
+					Name:  msg.Questions[0].Name,
+					Type:  dnsmessage.TypeA,
+					Class: dnsmessage.ClassINET,
+					TTL:   60,
+				},
+				Body: &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+			}}
+		}
+
+		answer, _ := msg.Pack()
+
+		w.Header().Set("content-type", "application/dns-message")
+		w.Write(answer)
+	})
+
+	mux.HandleFunc("/cookie-set", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{
+			Name:  r.URL.Query().Get("cookieName"),
+			Value: r.URL.Query().Get("cookieValue"),
+		})
+	})
+
+	return mux
+}
+
+// startConnectProxy starts an HTTP proxy that tunnels CONNECT requests and
+// returns its address.
+func startConnectProxy(t *testing.T) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		target, err := net.Dial("tcp", r.Host)
+
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		client, _, err := w.(http.Hijacker).Hijack()
+
+		if err != nil {
+			target.Close()
+			return
+		}
+
+		go func() {
+			io.Copy(target, client)
+			target.Close()
+		}()
+
+		io.Copy(client, target)
+		client.Close()
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server.Listener.Addr().String()
+}
+
+func TestMain(m *testing.M) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		panic(err)
+	}
+
+	testServerPort = listener.Addr().(*net.TCPAddr).Port
+
+	go http.Serve(listener, testServerMux())
+
+	tlsServer := httptest.NewUnstartedServer(testServerMux())
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+
+	testTLSServerPort = tlsServer.Listener.Addr().(*net.TCPAddr).Port
+	testTLSServerCert = tlsServer.Certificate()
+
+	code := m.Run()
+
+	tlsServer.Close()
+	listener.Close()
+	os.Exit(code)
+}
@@ -0,0 +1,19 @@
+module github.com/vimbing/fhttp
+
+go 1.24
+
+toolchain go1.24.0
+
+require (
+	golang.org/x/net v0.38.0
+	golang.org/x/term v0.30.0
+)
+
+require (
+	github.com/andybalholm/brotli v1.0.6 // indirect
+	github.com/klauspost/compress v1.17.4 // indirect
+	github.com/vimbing/utls v0.0.0-20251004215131-7e5a6b2681bc // indirect
+	golang.org/x/crypto v0.36.0 // indirect
+	golang.org/x/sys v0.31.0 // indirect
+	golang.org/x/text v0.23.0 // indirect
+)
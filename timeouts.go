@@ -0,0 +1,211 @@
+package http_client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vimbing/fhttp/httptrace"
+)
+
+type requestExecutionKey struct{}
+
+// merge returns t with every non-zero field of override applied on top.
+func (t Timeouts) merge(override Timeouts) Timeouts {
+	pick := func(base, override time.Duration) time.Duration {
+		if override != 0 {
+			return override
+		}
+
+		return base
+	}
+
+	return Timeouts{
+		Total:        pick(t.Total, override.Total),
+		DNS:          pick(t.DNS, override.DNS),
+		Dial:         pick(t.Dial, override.Dial),
+		ProxyConnect: pick(t.ProxyConnect, override.ProxyConnect),
+		TLSHandshake: pick(t.TLSHandshake, override.TLSHandshake),
+		FirstByte:    pick(t.FirstByte, override.FirstByte),
+		BodyRead:     pick(t.BodyRead, override.BodyRead),
+	}
+}
+
+func newRequestExecution(timeouts Timeouts, hooks Hooks) *requestExecution {
+	return &requestExecution{
+		timeouts: timeouts,
+		hooks:    hooks,
+		clock:    newPhaseClock(),
+	}
+}
+
+// bind derives the context the request runs under. The execution can be
+// recovered from it by the dialers, and phase timers cancel it.
+func (e *requestExecution) bind(parent context.Context) (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	e.cancel = cancel
+
+	ctx = context.WithValue(ctx, requestExecutionKey{}, e)
+	ctx = httptrace.WithClientTrace(ctx, e.clientTrace())
+
+	return ctx, cancel
+}
+
+func executionFromContext(ctx context.Context) *requestExecution {
+	exec, _ := ctx.Value(requestExecutionKey{}).(*requestExecution)
+	return exec
+}
+
+// contextTimeouts returns the timeouts of the request ctx belongs to, or
+// fallback for connections dialed outside of a request.
+func contextTimeouts(ctx context.Context, fallback Timeouts) Timeouts {
+	if exec := executionFromContext(ctx); exec != nil {
+		return exec.timeouts
+	}
+
+	return fallback
+}
+
+// enterPhase records phase on the request ctx belongs to, if any.
+func enterPhase(ctx context.Context, phase RequestPhase) {
+	if exec := executionFromContext(ctx); exec != nil {
+		exec.setPhase(phase)
+	}
+}
+
+func (e *requestExecution) setPhase(phase RequestPhase) {
+	e.phase.Store(phase)
+	e.clock.enter(phase)
+}
+
+func (e *requestExecution) currentPhase() RequestPhase {
+	phase, _ := e.phase.Load().(RequestPhase)
+	return phase
+}
+
+// startPhaseTimer cancels the request with a TimeoutError for phase unless
+// the returned stop func is called within d.
+func (e *requestExecution) startPhaseTimer(phase RequestPhase, d time.Duration) (stop func() bool) {
+	if d <= 0 || e.cancel == nil {
+		return func() bool { return true }
+	}
+
+	timer := time.AfterFunc(d, func() {
+		e.cancel(&TimeoutError{Phase: phase})
+	})
+
+	return timer.Stop
+}
+
+func (e *requestExecution) clientTrace() *httptrace.ClientTrace {
+	var (
+		mu            sync.Mutex
+		stopFirstByte func() bool
+	)
+
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			connInfo := newConnInfo(info)
+			e.connInfo.Store(&connInfo)
+			e.clock.mark(&e.clock.gotConn)
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			e.clock.mark(&e.clock.wroteRequest)
+
+			if stopFirstByte != nil {
+				stopFirstByte()
+			}
+
+			e.setPhase(PhaseResponseHeaders)
+			stopFirstByte = e.startPhaseTimer(PhaseResponseHeaders, e.timeouts.FirstByte)
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
+
+			e.clock.mark(&e.clock.firstByte)
+
+			if e.hooks.OnFirstByte != nil {
+				e.hooks.OnFirstByte()
+			}
+
+			if stopFirstByte != nil {
+				stopFirstByte()
+				stopFirstByte = nil
+			}
+		},
+	}
+}
+
+// timeoutErr converts err into a TimeoutError when it was caused by one of
+// the request deadlines, either the total one or the one of a single phase.
+func (e *requestExecution) timeoutErr(ctx context.Context, err error) error {
+	var timeoutErr *TimeoutError
+
+	if errors.As(context.Cause(ctx), &timeoutErr) {
+		return timeoutErr
+	}
+
+	if errors.As(err, &timeoutErr) {
+		return timeoutErr
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &TimeoutError{Phase: e.currentPhase()}
+	}
+
+	var netErr net.Error
+
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &TimeoutError{Phase: e.currentPhase()}
+	}
+
+	return err
+}
+
+// phaseContext bounds ctx by the budget of a single phase, a zero budget
+// leaves only the deadline of the request itself.
+func phaseContext(ctx context.Context, phase RequestPhase, d time.Duration) (context.Context, context.CancelFunc) {
+	enterPhase(ctx, phase)
+
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeoutCause(ctx, d, &TimeoutError{Phase: phase})
+}
+
+// phaseErr reports err as a TimeoutError when the budget of the phase ctx
+// was created for ran out.
+func phaseErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	// Connection deadlines derived from ctx can trip right before its own
+	// timer does, give the timer the chance to record the cause.
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		<-ctx.Done()
+	}
+
+	var timeoutErr *TimeoutError
+
+	if errors.As(context.Cause(ctx), &timeoutErr) {
+		return timeoutErr
+	}
+
+	return err
+}
+
+// watchConn makes blocking reads and writes on conn fail once ctx is done.
+// The returned stop func reports false if that already happened.
+func watchConn(ctx context.Context, conn net.Conn) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+}
@@ -0,0 +1,166 @@
+package http_client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// silentListener accepts connections and never writes a byte back, so any
+// handshake against it stalls until the client gives up.
+func silentListener(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("Unexpected error while starting listener: %v", err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestRequestTimeoutOverride(t *testing.T) {
+	testCases := []struct {
+		clientTimeout  time.Duration
+		requestTimeout time.Duration
+		shouldError    bool
+	}{
+		{clientTimeout: 100 * time.Millisecond, requestTimeout: time.Second, shouldError: false},
+		{clientTimeout: time.Second, requestTimeout: 100 * time.Millisecond, shouldError: true},
+	}
+
+	for _, testCase := range testCases {
+		client := MustNew(
+			WithCustomTimeout(testCase.clientTimeout),
+		)
+
+		req, err := client.NewRequest(fmt.Sprintf("http://127.0.0.1:%d/timeout?timeoutMs=300", testServerPort))
+
+		if err != nil {
+			t.Fatalf("Unexpected error while creating request: %v", err)
+		}
+
+		req.SetTimeout(testCase.requestTimeout)
+
+		_, err = client.Do(req)
+
+		if testCase.shouldError != (err != nil) {
+			t.Errorf(
+				"Unexpected result for client timeout: %v request timeout: %v err: %v",
+				testCase.clientTimeout,
+				testCase.requestTimeout,
+				err,
+			)
+		}
+	}
+}
+
+func TestPhaseTimeouts(t *testing.T) {
+	silentAddr := silentListener(t)
+
+	testCases := []struct {
+		name          string
+		url           string
+		options       []any
+		expectedPhase RequestPhase
+	}{
+		{
+			name:          "first byte",
+			url:           fmt.Sprintf("http://127.0.0.1:%d/timeout?timeoutMs=1000", testServerPort),
+			options:       []any{WithTimeouts(Timeouts{FirstByte: 100 * time.Millisecond})},
+			expectedPhase: PhaseResponseHeaders,
+		},
+		{
+			name:          "body read",
+			url:           fmt.Sprintf("http://127.0.0.1:%d/slow-body?chunks=20&delayMs=50", testServerPort),
+			options:       []any{WithTimeouts(Timeouts{BodyRead: 100 * time.Millisecond})},
+			expectedPhase: PhaseBodyRead,
+		},
+		{
+			name: "tls handshake",
+			url:  fmt.Sprintf("https://%s/", silentAddr),
+			options: []any{
+				WithTlsProfile(chrome140Profile()),
+				WithTimeouts(Timeouts{TLSHandshake: 100 * time.Millisecond}),
+			},
+			expectedPhase: PhaseTLSHandshake,
+		},
+		{
+			name: "http proxy connect",
+			url:  fmt.Sprintf("http://127.0.0.1:%d/ping", testServerPort),
+			options: []any{
+				WithProxyParsed("http://" + silentAddr),
+				WithTimeouts(Timeouts{ProxyConnect: 100 * time.Millisecond}),
+			},
+			expectedPhase: PhaseProxyConnect,
+		},
+		{
+			name: "socks proxy connect",
+			url:  fmt.Sprintf("http://127.0.0.1:%d/ping", testServerPort),
+			options: []any{
+				WithProxyParsed("socks5://" + silentAddr),
+				WithTimeouts(Timeouts{ProxyConnect: 100 * time.Millisecond}),
+			},
+			expectedPhase: PhaseProxyConnect,
+		},
+	}
+
+	for _, testCase := range testCases {
+		client := MustNew(
+			append(testCase.options, WithCustomTimeout(5*time.Second))...,
+		)
+
+		started := time.Now()
+
+		_, err := client.Get(testCase.url)
+
+		var timeoutErr *TimeoutError
+
+		if !errors.As(err, &timeoutErr) {
+			t.Errorf("Expected *TimeoutError for %s, got: %v", testCase.name, err)
+			continue
+		}
+
+		if timeoutErr.Phase != testCase.expectedPhase {
+			t.Errorf("Unexpected timeout phase for %s, expected: %s got: %s", testCase.name, testCase.expectedPhase, timeoutErr.Phase)
+		}
+
+		if elapsed := time.Since(started); elapsed > time.Second {
+			t.Errorf("Phase timeout for %s was not enforced, request took %v", testCase.name, elapsed)
+		}
+	}
+}
+
+func TestTotalTimeoutReportsCurrentPhase(t *testing.T) {
+	client := MustNew(
+		WithTlsProfile(chrome140Profile()),
+		WithCustomTimeout(150*time.Millisecond),
+	)
+
+	_, err := client.Get(fmt.Sprintf("https://%s/", silentListener(t)))
+
+	var timeoutErr *TimeoutError
+
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("Expected *TimeoutError, got: %v", err)
+	}
+
+	if timeoutErr.Phase != PhaseTLSHandshake {
+		t.Errorf("Unexpected timeout phase, expected: %s got: %s", PhaseTLSHandshake, timeoutErr.Phase)
+	}
+}
@@ -0,0 +1,112 @@
+package http_client
+
+import (
+	"sync"
+	"time"
+)
+
+// Timings breaks the duration of a request down by phase. Phases that did
+// not happen, like DNS and connecting on a reused connection, are zero.
+type Timings struct {
+	DNS          time.Duration
+	Connect      time.Duration
+	ProxyConnect time.Duration
+	TLSHandshake time.Duration
+
+	// RequestWrite runs from getting a connection until the request is
+	// written.
+	RequestWrite time.Duration
+
+	// FirstByte runs from the request being written until the first byte
+	// of the response arrives.
+	FirstByte time.Duration
+	BodyRead  time.Duration
+
+	// Total runs until the body is read, response middleware is not
+	// included.
+	Total time.Duration
+}
+
+// phaseClock adds up the time a request spends in each phase. Phases can
+// be entered more than once, the SOCKS handshake for one is interrupted by
+// the dial to the proxy.
+type phaseClock struct {
+	mu sync.Mutex
+
+	start   time.Time
+	current RequestPhase
+	since   time.Time
+	spent   map[RequestPhase]time.Duration
+
+	gotConn      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+}
+
+func newPhaseClock() *phaseClock {
+	now := time.Now()
+
+	return &phaseClock{
+		start: now,
+		since: now,
+		spent: make(map[RequestPhase]time.Duration),
+	}
+}
+
+func (c *phaseClock) enter(phase RequestPhase) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	c.spent[c.current] += now.Sub(c.since)
+	c.current = phase
+	c.since = now
+}
+
+// mark stores the current time in event unless it is set already.
+func (c *phaseClock) mark(event *time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if event.IsZero() {
+		*event = time.Now()
+	}
+}
+
+func (c *phaseClock) timings() Timings {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	between := func(from, to time.Time) time.Duration {
+		if from.IsZero() || to.IsZero() {
+			return 0
+		}
+
+		return to.Sub(from)
+	}
+
+	spent := func(phase RequestPhase) time.Duration {
+		if phase == c.current {
+			return c.spent[phase] + time.Since(c.since)
+		}
+
+		return c.spent[phase]
+	}
+
+	return Timings{
+		DNS:          spent(PhaseDNS),
+		Connect:      spent(PhaseDial),
+		ProxyConnect: spent(PhaseProxyConnect),
+		TLSHandshake: spent(PhaseTLSHandshake),
+		RequestWrite: between(c.gotConn, c.wroteRequest),
+		FirstByte:    between(c.wroteRequest, c.firstByte),
+		BodyRead:     spent(PhaseBodyRead),
+		Total:        time.Since(c.start),
+	}
+}
+
+// Timings returns where the time of the request went.
+func (r *Response) Timings() Timings {
+	return r.timings
+}
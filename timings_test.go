@@ -0,0 +1,157 @@
+package http_client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	tls "github.com/vimbing/utls"
+)
+
+// delayedResolver answers like Resolver after waiting for delay.
+type delayedResolver struct {
+	Resolver
+	delay time.Duration
+}
+
+func (r delayedResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	time.Sleep(r.delay)
+	return r.Resolver.LookupIPAddr(ctx, host)
+}
+
+func TestTimings(t *testing.T) {
+	static, _ := NewStaticResolver(map[string][]string{"timing.test": {"127.0.0.1"}}, nil)
+
+	client := MustNew(
+		WithResolver(delayedResolver{Resolver: static, delay: 30 * time.Millisecond}),
+		WithInsecureSkipVerify(),
+		WithTlsProfile(chrome140Profile()),
+	)
+
+	res, err := client.Get(fmt.Sprintf("https://timing.test:%d/slow-body?chunks=3&delayMs=20", testTLSServerPort))
+
+	if err != nil {
+		t.Fatalf("Unexpected error while getting test server: %v", err)
+	}
+
+	timings := res.Timings()
+
+	if timings.DNS < 30*time.Millisecond {
+		t.Errorf("DNS timing below resolver delay: %v", timings.DNS)
+	}
+
+	if timings.Connect <= 0 || timings.TLSHandshake <= 0 || timings.FirstByte <= 0 {
+		t.Errorf("Missing connection timings: %+v", timings)
+	}
+
+	if timings.ProxyConnect != 0 {
+		t.Errorf("Unexpected proxy timing for direct connection: %v", timings.ProxyConnect)
+	}
+
+	if timings.BodyRead < 40*time.Millisecond {
+		t.Errorf("Body read timing below server delays: %v", timings.BodyRead)
+	}
+
+	sum := timings.DNS + timings.Connect + timings.TLSHandshake + timings.RequestWrite + timings.FirstByte + timings.BodyRead
+
+	if timings.Total < sum {
+		t.Errorf("Total %v is below the sum of its phases %v", timings.Total, sum)
+	}
+
+	// the connection is reused, nothing is dialed again
+	res, err = client.Get(fmt.Sprintf("https://timing.test:%d/ping", testTLSServerPort))
+
+	if err != nil {
+		t.Fatalf("Unexpected error while getting test server: %v", err)
+	}
+
+	if timings := res.Timings(); timings.DNS != 0 || timings.Connect != 0 || timings.TLSHandshake != 0 {
+		t.Errorf("Unexpected connection timings on reused connection: %+v", timings)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	proxyAddr := startConnectProxy(t)
+
+	testCases := []struct {
+		name          string
+		options       []any
+		url           string
+		expectedCalls []string
+	}{
+		{
+			name:          "direct tls",
+			options:       []any{},
+			url:           fmt.Sprintf("https://localhost:%d/ping", testTLSServerPort),
+			expectedCalls: []string{"dns localhost", "connect tcp", "tls true", "first byte"},
+		},
+		{
+			name:          "http proxy",
+			options:       []any{WithProxyParsed("http://" + proxyAddr)},
+			url:           fmt.Sprintf("https://127.0.0.1:%d/ping", testTLSServerPort),
+			expectedCalls: []string{"connect tcp", "connect tunnel", "tls true", "first byte"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		var (
+			mu    sync.Mutex
+			calls []string
+		)
+
+		record := func(call string) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			calls = append(calls, call)
+		}
+
+		client := MustNew(append(testCase.options,
+			WithInsecureSkipVerify(),
+			WithTlsProfile(chrome140Profile()),
+			WithIPFamily(IPFamilyIPv4),
+			WithHooks(Hooks{
+				OnDNSStart: func(host string) {
+					record("dns " + host)
+				},
+				OnConnectDone: func(info ConnectDoneInfo) {
+					if info.Err != nil {
+						record("connect error")
+					} else if len(info.Proxy) > 0 {
+						record("connect tunnel")
+					} else {
+						record("connect tcp")
+					}
+				},
+				OnTLSHandshakeDone: func(state tls.ConnectionState, err error) {
+					record(fmt.Sprintf("tls %t", err == nil && state.HandshakeComplete))
+				},
+				OnFirstByte: func() {
+					record("first byte")
+				},
+			}),
+		)...)
+
+		res, err := client.Get(testCase.url)
+
+		if err != nil {
+			t.Fatalf("Unexpected error for %s while getting test server: %v", testCase.name, err)
+		}
+
+		mu.Lock()
+
+		if !slices.Equal(calls, testCase.expectedCalls) {
+			t.Errorf("Unexpected hook calls for %s, expected: %v got: %v", testCase.name, testCase.expectedCalls, calls)
+		}
+
+		mu.Unlock()
+
+		if len(testCase.options) > 0 && res.Timings().ProxyConnect <= 0 {
+			t.Errorf("Missing proxy connect timing for %s", testCase.name)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package http_client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strings"
+
+	tls "github.com/vimbing/utls"
+)
+
+// tlsOptions gathers the TLS settings of a client that are not part of its
+// fingerprint.
+type tlsOptions struct {
+	sessionCache       tls.ClientSessionCache
+	rootCAs            *x509.CertPool
+	clientCertificates []tls.Certificate
+	pins               []certificatePins
+	keyLogWriter       io.Writer
+	echConfigs         []echConfigList
+	echResolver        ECHResolver
+}
+
+// PinKind selects what a certificate pin is a hash of.
+type PinKind int
+
+const (
+	// PinSPKISHA256 pins the SHA-256 of the certificate's public key info,
+	// which survives certificate renewal with the same key.
+	PinSPKISHA256 PinKind = iota
+	// PinCertificateSHA256 pins the SHA-256 of the whole DER certificate.
+	PinCertificateSHA256
+)
+
+type certificatePins struct {
+	hostPattern string
+	kind        PinKind
+	hashes      [][]byte
+}
+
+func (p certificatePins) matches(cert *x509.Certificate) bool {
+	var digest [sha256.Size]byte
+
+	switch p.kind {
+	case PinSPKISHA256:
+		digest = sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	case PinCertificateSHA256:
+		digest = sha256.Sum256(cert.Raw)
+	}
+
+	for _, hash := range p.hashes {
+		if bytes.Equal(hash, digest[:]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// verifyECHRejection checks the certificate of a server that rejected ECH
+// against the public name the outer ClientHello went to, the retry configs
+// it sent are only trusted when it holds that name.
+func (rt *roundTripper) verifyECHRejection(state tls.ConnectionState) error {
+	if rt.insecureSkipVerify {
+		return nil
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("tls: server rejecting ECH sent no certificate")
+	}
+
+	opts := x509.VerifyOptions{
+		DNSName:       state.ServerName,
+		Roots:         rt.tlsOptions.rootCAs,
+		Intermediates: x509.NewCertPool(),
+	}
+
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err := state.PeerCertificates[0].Verify(opts)
+
+	return err
+}
+
+// scopedSessionCache keeps the sessions of connections through one proxy
+// apart from the others in a shared cache, a ticket resumed through another
+// proxy would tell the server both exits are the same client.
+type scopedSessionCache struct {
+	cache tls.ClientSessionCache
+	scope string
+}
+
+// proxySessionCache scopes cache to proxy, direct connections use cache as
+// is.
+func proxySessionCache(cache tls.ClientSessionCache, proxy string) tls.ClientSessionCache {
+	if cache == nil || proxy == "" {
+		return cache
+	}
+
+	return scopedSessionCache{cache: cache, scope: proxy}
+}
+
+func (c scopedSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	return c.cache.Get(c.scope + " " + sessionKey)
+}
+
+func (c scopedSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.cache.Put(c.scope+" "+sessionKey, cs)
+}
+
+// verifyPins checks the certificates of host against every pin set that
+// covers host. Each set needs at least one certificate of a verified chain
+// to match, so roots and intermediates the server doesn't send can be
+// pinned. Without verification nothing ties the presented certificates to
+// the leaf, so only the leaf is checked.
+func (o tlsOptions) verifyPins(host string, state tls.ConnectionState) error {
+	chains := state.VerifiedChains
+
+	if len(chains) == 0 && len(state.PeerCertificates) > 0 {
+		chains = [][]*x509.Certificate{state.PeerCertificates[:1]}
+	}
+
+	for _, pins := range o.pins {
+		if !matchHost(pins.hostPattern, host) {
+			continue
+		}
+
+		matched := slices.ContainsFunc(chains, func(chain []*x509.Certificate) bool {
+			return slices.ContainsFunc(chain, pins.matches)
+		})
+
+		if !matched {
+			return &PinMismatchError{Host: host, Chain: state.PeerCertificates}
+		}
+	}
+
+	return nil
+}
+
+// matchHost reports whether host matches pattern, which is either an exact
+// host name or a wildcard like *.example.com covering any subdomain.
+func matchHost(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+
+	return pattern == host
+}
+
+// newTLSConn wraps rawConn in a uTLS client for host according to the
+// transport settings, the handshake is left to the caller.
+func (rt *roundTripper) newTLSConn(rawConn net.Conn, host string, echConfigList []byte) (*tls.UConn, error) {
+	config := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: rt.insecureSkipVerify,
+		RootCAs:            rt.tlsOptions.rootCAs,
+		Certificates:       rt.tlsOptions.clientCertificates,
+		KeyLogWriter:       rt.tlsOptions.keyLogWriter,
+	}
+
+	if len(echConfigList) > 0 {
+		config.EncryptedClientHelloConfigList = echConfigList
+		config.MinVersion = tls.VersionTLS13
+
+		// uTLS would check the certificate of a server rejecting ECH
+		// against host, handshake checks it against the public name
+		config.EncryptedClientHelloRejectionVerify = func(tls.ConnectionState) error { return nil }
+	}
+
+	helloID := rt.clientHelloId
+
+	spec, err := rt.helloShaping.apply(rt.clientHelloSpec, helloID, len(echConfigList) > 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config.Rand = rt.helloShaping.rand
+
+	if rt.tlsOptions.sessionCache != nil {
+		// Browsers only send the pre_shared_key extension when they hold a
+		// ticket for the server, OmitEmptyPsk mirrors that.
+		config.ClientSessionCache = rt.tlsOptions.sessionCache
+		config.OmitEmptyPsk = true
+
+		if spec, err = withPreSharedKeyExtension(spec, helloID); err != nil {
+			return nil, err
+		}
+	}
+
+	if spec != nil {
+		helloID = tls.HelloCustom
+	}
+
+	conn := tls.UClient(rawConn, config, helloID)
+
+	if spec != nil {
+		if err := conn.ApplyPreset(spec); err != nil {
+			return nil, err
+		}
+
+		rt.helloShaping.fixGREASE(conn)
+	}
+
+	return conn, nil
+}
+
+// withPreSharedKeyExtension returns spec, or the spec of helloID when spec
+// is nil, with a pre_shared_key extension so TLS 1.3 sessions can resume.
+func withPreSharedKeyExtension(spec *tls.ClientHelloSpec, helloID tls.ClientHelloID) (*tls.ClientHelloSpec, error) {
+	if spec == nil {
+		presetSpec, err := tls.UTLSIdToSpec(helloID)
+
+		if err != nil {
+			return nil, err
+		}
+
+		spec = &presetSpec
+	}
+
+	for _, ext := range spec.Extensions {
+		if _, ok := ext.(tls.PreSharedKeyExtension); ok {
+			return spec, nil
+		}
+	}
+
+	withPsk := *spec
+
+	// pre_shared_key has to be the last extension of the hello
+	withPsk.Extensions = append(
+		append([]tls.TLSExtension{}, spec.Extensions...),
+		&tls.UtlsPreSharedKeyExtension{},
+	)
+
+	return &withPsk, nil
+}
@@ -0,0 +1,572 @@
+package http_client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	tls "github.com/vimbing/utls"
+)
+
+func TestTLSSessionResumption(t *testing.T) {
+	sharedCache := tls.NewLRUClientSessionCache(0)
+
+	testCases := []struct {
+		name            string
+		options         []any
+		expectedResumed string
+	}{
+		{name: "default", options: []any{}, expectedResumed: "true"},
+		{name: "shared cache", options: []any{WithTLSSessionCache(sharedCache)}, expectedResumed: "true"},
+		{name: "disabled", options: []any{WithoutTLSSessionResumption()}, expectedResumed: "false"},
+	}
+
+	for _, testCase := range testCases {
+		client := MustNew(
+			append(testCase.options, WithInsecureSkipVerify(), WithTlsProfile(chrome140Profile()))...,
+		)
+
+		url := fmt.Sprintf("https://127.0.0.1:%d/tls-resumed", testTLSServerPort)
+
+		res, err := client.Get(url)
+
+		if err != nil {
+			t.Fatalf("Unexpected error for %s while getting test server: %v", testCase.name, err)
+		}
+
+		if res.BodyString() != "false" {
+			t.Errorf("First connection for %s should not resume a session", testCase.name)
+		}
+
+		// new transport, so the next request has to open a new connection
+		client.RotateProxy()
+
+		// tickets arrive after the handshake, the first response is proof
+		// enough that the client has read it
+		res, err = client.Get(url)
+
+		if err != nil {
+			t.Fatalf("Unexpected error for %s while getting test server: %v", testCase.name, err)
+		}
+
+		if res.BodyString() != testCase.expectedResumed {
+			t.Errorf("Unexpected resumption for %s, expected: %s got: %s", testCase.name, testCase.expectedResumed, res.BodyString())
+		}
+	}
+}
+
+func TestTLSSessionResumptionPerProxy(t *testing.T) {
+	first := startConnectProxy(t)
+	second := startConnectProxy(t)
+
+	client := MustNew(
+		WithInsecureSkipVerify(),
+		WithTlsProfile(chrome140Profile()),
+	)
+
+	url := fmt.Sprintf("https://127.0.0.1:%d/tls-resumed", testTLSServerPort)
+
+	steps := []struct {
+		proxy           string
+		expectedResumed string
+	}{
+		{proxy: first, expectedResumed: "false"},
+		{proxy: second, expectedResumed: "false"},
+		{proxy: first, expectedResumed: "true"},
+	}
+
+	for i, step := range steps {
+		client.ChangeProxyParsed("http://" + step.proxy)
+
+		res, err := client.Get(url)
+
+		if err != nil {
+			t.Fatalf("Unexpected error for step %d while getting test server: %v", i, err)
+		}
+
+		if res.BodyString() != step.expectedResumed {
+			t.Errorf("Unexpected resumption for step %d, expected: %s got: %s", i, step.expectedResumed, res.BodyString())
+		}
+	}
+}
+
+func TestTLSSessionResumptionProfileSwitch(t *testing.T) {
+	profile := chrome140Profile()
+	profile.DisableSessionResumption = true
+
+	client := MustNew(
+		WithInsecureSkipVerify(),
+		WithTlsProfile(profile),
+	)
+
+	url := fmt.Sprintf("https://127.0.0.1:%d/tls-resumed", testTLSServerPort)
+
+	for i := 0; i < 2; i++ {
+		client.RotateProxy()
+
+		res, err := client.Get(url)
+
+		if err != nil {
+			t.Fatalf("Unexpected error while getting test server: %v", err)
+		}
+
+		if res.BodyString() != "false" {
+			t.Errorf("Session resumed although the profile disables it")
+		}
+	}
+}
+
+type capturedClientHello struct {
+	raw        []byte
+	extensions []uint16
+	alpn       []string
+}
+
+// captureClientHello points client at a listener that records the first
+// ClientHello it receives and then hangs up.
+func captureClientHello(t *testing.T, client *Client) *capturedClientHello {
+	return captureClientHelloFrom(t, func(addr string) {
+		client.Get(fmt.Sprintf("https://%s/", addr))
+	})
+}
+
+// captureClientHelloFrom is like captureClientHello, but lets send issue the
+// request to the listener at addr.
+func captureClientHelloFrom(t *testing.T, send func(addr string)) *capturedClientHello {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("Unexpected error while starting listener: %v", err)
+	}
+
+	defer listener.Close()
+
+	helloChan := make(chan []byte, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			helloChan <- nil
+			return
+		}
+
+		defer conn.Close()
+
+		header := make([]byte, 5)
+
+		if _, err := io.ReadFull(conn, header); err != nil {
+			helloChan <- nil
+			return
+		}
+
+		record := make([]byte, binary.BigEndian.Uint16(header[3:5]))
+
+		if _, err := io.ReadFull(conn, record); err != nil {
+			helloChan <- nil
+			return
+		}
+
+		helloChan <- record
+	}()
+
+	go send(listener.Addr().String())
+
+	record := <-helloChan
+
+	if record == nil {
+		t.Fatalf("No ClientHello was captured")
+	}
+
+	return parseClientHello(t, record)
+}
+
+func parseClientHello(t *testing.T, record []byte) *capturedClientHello {
+	hello := &capturedClientHello{raw: record}
+
+	// handshake header, legacy version and random
+	rest := record[4+2+32:]
+
+	skip := func(lengthBytes int) {
+		length := 0
+
+		for _, b := range rest[:lengthBytes] {
+			length = length<<8 | int(b)
+		}
+
+		rest = rest[lengthBytes+length:]
+	}
+
+	skip(1) // session id
+	skip(2) // cipher suites
+	skip(1) // compression methods
+
+	extensions := rest[2 : 2+int(binary.BigEndian.Uint16(rest[:2]))]
+
+	for len(extensions) >= 4 {
+		extType := binary.BigEndian.Uint16(extensions[:2])
+		extLen := int(binary.BigEndian.Uint16(extensions[2:4]))
+		extData := extensions[4 : 4+extLen]
+
+		hello.extensions = append(hello.extensions, extType)
+
+		if extType == 16 {
+			protocols := extData[2:]
+
+			for len(protocols) > 0 {
+				protoLen := int(protocols[0])
+				hello.alpn = append(hello.alpn, string(protocols[1:1+protoLen]))
+				protocols = protocols[1+protoLen:]
+			}
+		}
+
+		extensions = extensions[4+extLen:]
+	}
+
+	return hello
+}
+
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	return slices.DeleteFunc(slices.Clone(values), isGREASE)
+}
+
+func TestTLSSessionResumptionKeepsFirstHello(t *testing.T) {
+	withResumption := captureClientHello(t, MustNew(
+		WithTlsProfile(chrome140Profile()),
+	))
+
+	withoutResumption := captureClientHello(t, MustNew(
+		WithTlsProfile(chrome140Profile()),
+		WithoutTLSSessionResumption(),
+	))
+
+	if slices.Contains(withResumption.extensions, 41) {
+		t.Errorf("First ClientHello carries a pre_shared_key extension without a ticket")
+	}
+
+	if !slices.Equal(withoutGREASE(withResumption.extensions), withoutGREASE(withoutResumption.extensions)) {
+		t.Errorf(
+			"Resumption changed the first ClientHello, with: %v without: %v",
+			withResumption.extensions,
+			withoutResumption.extensions,
+		)
+	}
+}
+
+func TestRootCAs(t *testing.T) {
+	trusted := x509.NewCertPool()
+	trusted.AddCert(testTLSServerCert)
+
+	testCases := []struct {
+		name        string
+		pool        *x509.CertPool
+		expectError bool
+	}{
+		{name: "trusted", pool: trusted, expectError: false},
+		{name: "untrusted", pool: x509.NewCertPool(), expectError: true},
+	}
+
+	for _, testCase := range testCases {
+		client := MustNew(
+			WithRootCAs(testCase.pool),
+			WithTlsProfile(chrome140Profile()),
+		)
+
+		_, err := client.Get(fmt.Sprintf("https://127.0.0.1:%d/ping", testTLSServerPort))
+
+		if (err != nil) != testCase.expectError {
+			t.Errorf("Unexpected result for %s, expected error: %t got: %v", testCase.name, testCase.expectError, err)
+		}
+	}
+}
+
+func TestCertificatePinning(t *testing.T) {
+	spki := sha256.Sum256(testTLSServerCert.RawSubjectPublicKeyInfo)
+	certHash := sha256.Sum256(testTLSServerCert.Raw)
+	other := sha256.Sum256([]byte("other"))
+
+	spkiPin := base64.StdEncoding.EncodeToString(spki[:])
+	certPin := base64.StdEncoding.EncodeToString(certHash[:])
+	otherPin := base64.StdEncoding.EncodeToString(other[:])
+
+	testCases := []struct {
+		name           string
+		option         OptionCertificatePins
+		expectMismatch bool
+	}{
+		{name: "spki", option: WithSPKIPins("127.0.0.1", otherPin, spkiPin), expectMismatch: false},
+		{name: "spki prefixed", option: WithSPKIPins("127.0.0.1", "sha256/"+spkiPin), expectMismatch: false},
+		{name: "certificate", option: WithCertificateHashPins("127.0.0.1", certPin), expectMismatch: false},
+		{name: "mismatch", option: WithSPKIPins("127.0.0.1", otherPin), expectMismatch: true},
+		{name: "other host", option: WithSPKIPins("*.example.com", otherPin), expectMismatch: false},
+	}
+
+	for _, testCase := range testCases {
+		// pins are enforced even when chain verification is skipped
+		client := MustNew(
+			testCase.option,
+			WithInsecureSkipVerify(),
+			WithTlsProfile(chrome140Profile()),
+		)
+
+		_, err := client.Get(fmt.Sprintf("https://127.0.0.1:%d/ping", testTLSServerPort))
+
+		var mismatch *PinMismatchError
+
+		if errors.As(err, &mismatch) != testCase.expectMismatch {
+			t.Errorf("Unexpected result for %s, expected mismatch: %t got: %v", testCase.name, testCase.expectMismatch, err)
+		}
+
+		if testCase.expectMismatch && mismatch.Host != "127.0.0.1" {
+			t.Errorf("Unexpected host in pin mismatch for %s: %s", testCase.name, mismatch.Host)
+		}
+	}
+}
+
+func TestCertificatePinningRoot(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "pinned root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+
+	if err != nil {
+		t.Fatalf("Unexpected error while creating root: %v", err)
+	}
+
+	ca, _ := x509.ParseCertificate(caDER)
+
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}, ca, &leafKey.PublicKey, caKey)
+
+	if err != nil {
+		t.Fatalf("Unexpected error while creating leaf: %v", err)
+	}
+
+	// the server leaves the root out of the chain it presents
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &stdtls.Config{Certificates: []stdtls.Certificate{{Certificate: [][]byte{leafDER}, PrivateKey: leafKey}}}
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	spki := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+
+	client := MustNew(
+		WithRootCAs(roots),
+		WithSPKIPins("127.0.0.1", base64.StdEncoding.EncodeToString(spki[:])),
+		WithTlsProfile(chrome140Profile()),
+	)
+
+	if _, err := client.Get(server.URL); err != nil {
+		t.Errorf("Unexpected error with a pinned root: %v", err)
+	}
+}
+
+func TestCertificatePinningUnverifiedChain(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	forgedKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "pinned intermediate"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	caDER, _ := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	ca, _ := x509.ParseCertificate(caDER)
+
+	forgedTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	forgedDER, err := x509.CreateCertificate(rand.Reader, forgedTemplate, forgedTemplate, &forgedKey.PublicKey, forgedKey)
+
+	if err != nil {
+		t.Fatalf("Unexpected error while creating leaf: %v", err)
+	}
+
+	// a self-signed leaf followed by the real, pinned intermediate
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &stdtls.Config{Certificates: []stdtls.Certificate{{Certificate: [][]byte{forgedDER, caDER}, PrivateKey: forgedKey}}}
+	server.StartTLS()
+	defer server.Close()
+
+	spki := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+
+	client := MustNew(
+		WithInsecureSkipVerify(),
+		WithSPKIPins("127.0.0.1", base64.StdEncoding.EncodeToString(spki[:])),
+		WithTlsProfile(chrome140Profile()),
+	)
+
+	var mismatch *PinMismatchError
+
+	if _, err := client.Get(server.URL); !errors.As(err, &mismatch) {
+		t.Errorf("Expected a pin mismatch for the forged leaf, got: %v", err)
+	}
+}
+
+func TestInvalidCertificatePin(t *testing.T) {
+	if _, err := New(WithSPKIPins("example.com", "not a pin")); err == nil {
+		t.Fatalf("Expected error for invalid pin")
+	}
+
+	if _, err := New(WithSPKIPins("example.com")); err == nil {
+		t.Fatalf("Expected error for empty pin set")
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	testCases := []struct {
+		pattern  string
+		host     string
+		expected bool
+	}{
+		{pattern: "example.com", host: "example.com", expected: true},
+		{pattern: "example.com", host: "EXAMPLE.com", expected: true},
+		{pattern: "example.com", host: "api.example.com", expected: false},
+		{pattern: "*.example.com", host: "api.example.com", expected: true},
+		{pattern: "*.example.com", host: "a.b.example.com", expected: true},
+		{pattern: "*.example.com", host: "example.com", expected: false},
+		{pattern: "*.example.com", host: "badexample.com", expected: false},
+	}
+
+	for _, testCase := range testCases {
+		if got := matchHost(testCase.pattern, testCase.host); got != testCase.expected {
+			t.Errorf("Unexpected match of %s against %s, expected: %t got: %t", testCase.host, testCase.pattern, testCase.expected, got)
+		}
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &stdtls.Config{ClientAuth: stdtls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	certPEM, keyPEM := generateClientCertificate(t, "partner-client")
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+
+	os.WriteFile(certFile, certPEM, 0o600)
+	os.WriteFile(keyFile, keyPEM, 0o600)
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+
+	if err != nil {
+		t.Fatalf("Unexpected error while loading client certificate: %v", err)
+	}
+
+	testCases := []struct {
+		name   string
+		option OptionClientCertificate
+	}{
+		{name: "certificate", option: WithClientCertificate(cert)},
+		{name: "files", option: WithClientCertificateFiles(certFile, keyFile)},
+	}
+
+	for _, testCase := range testCases {
+		client := MustNew(
+			testCase.option,
+			WithInsecureSkipVerify(),
+			WithTlsProfile(chrome140Profile()),
+		)
+
+		res, err := client.Get(server.URL)
+
+		if err != nil {
+			t.Fatalf("Unexpected error for %s while getting mTLS server: %v", testCase.name, err)
+		}
+
+		if res.BodyString() != "partner-client" {
+			t.Errorf("Unexpected client certificate for %s: %s", testCase.name, res.BodyString())
+		}
+	}
+
+	if _, err := New(WithClientCertificateFiles(filepath.Join(dir, "missing.crt"), keyFile)); err == nil {
+		t.Errorf("Expected error for missing client certificate file")
+	}
+}
+
+func generateClientCertificate(t *testing.T, commonName string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatalf("Unexpected error while generating key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatalf("Unexpected error while creating certificate: %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		t.Fatalf("Unexpected error while marshaling key: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
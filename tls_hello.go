@@ -0,0 +1,384 @@
+package http_client
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"io"
+	"math/rand/v2"
+	"sync"
+
+	tls "github.com/vimbing/utls"
+)
+
+// GREASEMode selects how the GREASE values of a ClientHello are chosen.
+type GREASEMode int
+
+const (
+	// GREASERandom picks fresh GREASE values for every connection, like
+	// BoringSSL does.
+	GREASERandom GREASEMode = iota
+	// GREASEStatic always sends the same GREASE values.
+	GREASEStatic
+	// GREASEOff removes GREASE cipher suites, extensions, groups and
+	// versions from the hello.
+	GREASEOff
+)
+
+// PaddingMode selects whether a ClientHello carries the padding extension.
+type PaddingMode int
+
+const (
+	// PaddingProfile pads exactly when the profile's spec does.
+	PaddingProfile PaddingMode = iota
+	// PaddingBoring pads hellos the way BoringSSL does, whether or not the
+	// spec includes the extension.
+	PaddingBoring
+	// PaddingOff never sends the padding extension.
+	PaddingOff
+)
+
+// extensionECH is the encrypted_client_hello extension type, uTLS does not
+// export it.
+const extensionECH = 0xfe0d
+
+// staticGREASE are the values GREASEStatic uses, one per kind of field.
+var staticGREASE = struct {
+	cipher, group, version, extension1, extension2 uint16
+}{
+	cipher:     0x0a0a,
+	group:      0x2a2a,
+	version:    0x3a3a,
+	extension1: 0x4a4a,
+	extension2: 0x5a5a,
+}
+
+// helloShaping holds the per connection ClientHello switches of a profile.
+type helloShaping struct {
+	shuffleExtensions bool
+	grease            GREASEMode
+	padding           PaddingMode
+
+	// alpn replaces the ALPN list of the spec when set.
+	alpn []string
+
+	// rand feeds the handshake and the extension permutation, nil means
+	// crypto/rand.
+	rand io.Reader
+}
+
+func (s helloShaping) enabled() bool {
+	return s.shuffleExtensions || s.grease != GREASERandom || s.padding != PaddingProfile || s.alpn != nil || s.rand != nil
+}
+
+// apply returns a copy of spec, or of the spec of helloID when spec is nil,
+// with the switches applied. The extension objects of spec are not
+// modified. withECH tells whether the connection offers real ECH.
+func (s helloShaping) apply(spec *tls.ClientHelloSpec, helloID tls.ClientHelloID, withECH bool) (*tls.ClientHelloSpec, error) {
+	if !s.enabled() {
+		return spec, nil
+	}
+
+	if spec == nil {
+		presetSpec, err := tls.UTLSIdToSpec(helloID)
+
+		if err != nil {
+			return nil, err
+		}
+
+		spec = &presetSpec
+	}
+
+	shaped := *spec
+	shaped.CipherSuites = append([]uint16{}, spec.CipherSuites...)
+	shaped.Extensions = append([]tls.TLSExtension{}, spec.Extensions...)
+
+	if s.grease == GREASEOff {
+		removeGREASE(&shaped)
+	}
+
+	if s.alpn != nil {
+		shaped.Extensions = rewriteALPN(shaped.Extensions, s.alpn)
+	}
+
+	switch s.padding {
+	case PaddingOff:
+		shaped.Extensions = removeExtensions(shaped.Extensions, func(ext tls.TLSExtension) bool {
+			_, ok := ext.(*tls.UtlsPaddingExtension)
+			return ok
+		})
+	case PaddingBoring:
+		shaped.Extensions = removeExtensions(shaped.Extensions, func(ext tls.TLSExtension) bool {
+			_, ok := ext.(*tls.UtlsPaddingExtension)
+			return ok
+		})
+		shaped.Extensions = insertPadding(shaped.Extensions)
+	}
+
+	if s.rand != nil && !withECH {
+		if err := s.seedGREASEECH(shaped.Extensions); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.shuffleExtensions {
+		if err := s.shuffle(shaped.Extensions); err != nil {
+			return nil, err
+		}
+	}
+
+	return &shaped, nil
+}
+
+// seedGREASEECH replaces GREASE ECH extensions, which uTLS fills from
+// crypto/rand, with identical looking ones built from s.rand.
+func (s helloShaping) seedGREASEECH(extensions []tls.TLSExtension) error {
+	for i, ext := range extensions {
+		if _, ok := ext.(*tls.GREASEEncryptedClientHelloExtension); !ok {
+			continue
+		}
+
+		// choices for config id, cipher suite and payload length, the
+		// encapsulated X25519 key and the payload itself
+		var choices [3]byte
+		var enc [32]byte
+
+		if _, err := io.ReadFull(s.rand, choices[:]); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(s.rand, enc[:]); err != nil {
+			return err
+		}
+
+		// HKDF-SHA256 with AES-128-GCM or ChaCha20-Poly1305, and BoringSSL's
+		// payload lengths including the AEAD tag
+		aead := []uint16{0x0001, 0x0003}[choices[1]%2]
+		payload := make([]byte, []int{144, 176, 208, 240}[choices[2]%4])
+
+		if _, err := io.ReadFull(s.rand, payload); err != nil {
+			return err
+		}
+
+		data := []byte{0} // outer ClientHello
+		data = binary.BigEndian.AppendUint16(data, 0x0001)
+		data = binary.BigEndian.AppendUint16(data, aead)
+		data = append(data, choices[0])
+		data = binary.BigEndian.AppendUint16(data, uint16(len(enc)))
+		data = append(data, enc[:]...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(payload)))
+		data = append(data, payload...)
+
+		extensions[i] = &tls.GenericExtension{Id: extensionECH, Data: data}
+	}
+
+	return nil
+}
+
+// shuffle permutes extensions like Chrome does, GREASE, padding and
+// pre_shared_key stay where they are.
+func (s helloShaping) shuffle(extensions []tls.TLSExtension) error {
+	source := s.rand
+
+	if source == nil {
+		source = crand.Reader
+	}
+
+	var seed [32]byte
+
+	if _, err := io.ReadFull(source, seed[:]); err != nil {
+		return err
+	}
+
+	fixed := func(ext tls.TLSExtension) bool {
+		switch ext.(type) {
+		case *tls.UtlsGREASEExtension, *tls.UtlsPaddingExtension, tls.PreSharedKeyExtension:
+			return true
+		default:
+			return false
+		}
+	}
+
+	var movable []int
+
+	for i, ext := range extensions {
+		if !fixed(ext) {
+			movable = append(movable, i)
+		}
+	}
+
+	rand.New(rand.NewChaCha8(seed)).Shuffle(len(movable), func(i, j int) {
+		extensions[movable[i]], extensions[movable[j]] = extensions[movable[j]], extensions[movable[i]]
+	})
+
+	return nil
+}
+
+// fixGREASE overwrites the GREASE values uTLS picked for conn with the
+// static ones. It has to run after the preset is applied and before the
+// hello is marshaled.
+func (s helloShaping) fixGREASE(conn *tls.UConn) {
+	if s.grease != GREASEStatic {
+		return
+	}
+
+	hello := conn.HandshakeState.Hello
+
+	for i, suite := range hello.CipherSuites {
+		if isGREASEValue(suite) {
+			hello.CipherSuites[i] = staticGREASE.cipher
+		}
+	}
+
+	greaseExtensions := 0
+
+	for _, ext := range conn.Extensions {
+		switch ext := ext.(type) {
+		case *tls.UtlsGREASEExtension:
+			if greaseExtensions == 0 {
+				ext.Value = staticGREASE.extension1
+			} else {
+				ext.Value = staticGREASE.extension2
+			}
+
+			greaseExtensions++
+		case *tls.SupportedCurvesExtension:
+			for i, curve := range ext.Curves {
+				if isGREASEValue(uint16(curve)) {
+					ext.Curves[i] = tls.CurveID(staticGREASE.group)
+				}
+			}
+		case *tls.KeyShareExtension:
+			for i, share := range ext.KeyShares {
+				if isGREASEValue(uint16(share.Group)) {
+					ext.KeyShares[i].Group = tls.CurveID(staticGREASE.group)
+				}
+			}
+		case *tls.SupportedVersionsExtension:
+			for i, version := range ext.Versions {
+				if isGREASEValue(version) {
+					ext.Versions[i] = staticGREASE.version
+				}
+			}
+		}
+	}
+}
+
+func removeGREASE(spec *tls.ClientHelloSpec) {
+	spec.CipherSuites = removeGREASEValues(spec.CipherSuites)
+
+	extensions := spec.Extensions[:0]
+
+	for _, ext := range spec.Extensions {
+		switch ext := ext.(type) {
+		case *tls.UtlsGREASEExtension:
+			continue
+		case *tls.SupportedCurvesExtension:
+			curves := make([]tls.CurveID, 0, len(ext.Curves))
+
+			for _, curve := range ext.Curves {
+				if !isGREASEValue(uint16(curve)) {
+					curves = append(curves, curve)
+				}
+			}
+
+			extensions = append(extensions, &tls.SupportedCurvesExtension{Curves: curves})
+		case *tls.KeyShareExtension:
+			shares := make([]tls.KeyShare, 0, len(ext.KeyShares))
+
+			for _, share := range ext.KeyShares {
+				if !isGREASEValue(uint16(share.Group)) {
+					shares = append(shares, share)
+				}
+			}
+
+			extensions = append(extensions, &tls.KeyShareExtension{KeyShares: shares})
+		case *tls.SupportedVersionsExtension:
+			extensions = append(extensions, &tls.SupportedVersionsExtension{
+				Versions: removeGREASEValues(ext.Versions),
+			})
+		default:
+			extensions = append(extensions, ext)
+		}
+	}
+
+	spec.Extensions = extensions
+}
+
+func removeGREASEValues(values []uint16) []uint16 {
+	filtered := make([]uint16, 0, len(values))
+
+	for _, value := range values {
+		if !isGREASEValue(value) {
+			filtered = append(filtered, value)
+		}
+	}
+
+	return filtered
+}
+
+func removeExtensions(extensions []tls.TLSExtension, remove func(tls.TLSExtension) bool) []tls.TLSExtension {
+	filtered := extensions[:0]
+
+	for _, ext := range extensions {
+		if !remove(ext) {
+			filtered = append(filtered, ext)
+		}
+	}
+
+	return filtered
+}
+
+// insertPadding adds BoringSSL style padding as the last extension, before
+// a trailing GREASE extension or pre_shared_key.
+func insertPadding(extensions []tls.TLSExtension) []tls.TLSExtension {
+	at := len(extensions)
+
+	for at > 0 {
+		switch extensions[at-1].(type) {
+		case *tls.UtlsGREASEExtension, tls.PreSharedKeyExtension:
+			at--
+			continue
+		}
+
+		break
+	}
+
+	padding := &tls.UtlsPaddingExtension{GetPaddingLen: tls.BoringPaddingStyle}
+
+	return append(extensions[:at], append([]tls.TLSExtension{padding}, extensions[at:]...)...)
+}
+
+// isGREASEValue reports whether v is one of the reserved GREASE values from
+// RFC 8701.
+func isGREASEValue(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// seededReader is a deterministic stream of random bytes, safe for
+// concurrent use.
+type seededReader struct {
+	mu     sync.Mutex
+	source *rand.ChaCha8
+}
+
+func newSeededReader(seed uint64) *seededReader {
+	var key [32]byte
+	binary.LittleEndian.PutUint64(key[:], seed)
+
+	return &seededReader{source: rand.NewChaCha8(key)}
+}
+
+func (r *seededReader) Read(p []byte) (int, error) {
+	// crypto/ecdh reads a single byte at random to keep callers from
+	// depending on its output, answering those without advancing the stream
+	// keeps the rest of the handshake reproducible.
+	if len(p) == 1 {
+		p[0] = 0
+		return 1, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.source.Read(p)
+}
@@ -0,0 +1,176 @@
+package http_client
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	tls "github.com/vimbing/utls"
+)
+
+func TestShuffleExtensions(t *testing.T) {
+	testCases := []struct {
+		name          string
+		shuffle       bool
+		expectShuffle bool
+	}{
+		{name: "fixed order", shuffle: false, expectShuffle: false},
+		{name: "shuffled", shuffle: true, expectShuffle: true},
+	}
+
+	for _, testCase := range testCases {
+		profile := chrome140Profile()
+		profile.ShuffleExtensions = testCase.shuffle
+
+		client := MustNew(WithTlsProfile(profile))
+
+		first := captureClientHello(t, client).extensions
+		shuffled := false
+
+		for i := 0; i < 8; i++ {
+			extensions := captureClientHello(t, client).extensions
+
+			if !isGREASE(extensions[0]) || !isGREASE(extensions[len(extensions)-1]) {
+				t.Errorf("GREASE extensions moved for %s: %v", testCase.name, extensions)
+			}
+
+			if !slices.Equal(sortedExtensions(extensions), sortedExtensions(first)) {
+				t.Fatalf("Unexpected extension set for %s, expected: %v got: %v", testCase.name, first, extensions)
+			}
+
+			if !slices.Equal(withoutGREASE(extensions), withoutGREASE(first)) {
+				shuffled = true
+			}
+		}
+
+		if shuffled != testCase.expectShuffle {
+			t.Errorf("Unexpected extension order for %s, expected shuffle: %t", testCase.name, testCase.expectShuffle)
+		}
+	}
+}
+
+func TestTLSSeed(t *testing.T) {
+	profile := chrome140Profile()
+	profile.ShuffleExtensions = true
+
+	capture := func(seed uint64) []byte {
+		return captureClientHello(t, MustNew(WithTlsProfile(profile), WithTLSSeed(seed))).raw
+	}
+
+	if !bytes.Equal(capture(42), capture(42)) {
+		t.Errorf("ClientHello differs between clients with the same seed")
+	}
+
+	if bytes.Equal(capture(42), capture(43)) {
+		t.Errorf("ClientHello is the same for different seeds")
+	}
+}
+
+func TestGREASEModes(t *testing.T) {
+	testCases := []struct {
+		name           string
+		mode           GREASEMode
+		expectedGREASE []uint16
+	}{
+		{name: "static", mode: GREASEStatic, expectedGREASE: []uint16{0x4a4a, 0x5a5a}},
+		{name: "off", mode: GREASEOff, expectedGREASE: nil},
+	}
+
+	for _, testCase := range testCases {
+		profile := chrome140Profile()
+		profile.GREASE = testCase.mode
+
+		client := MustNew(WithTlsProfile(profile))
+
+		for i := 0; i < 2; i++ {
+			var grease []uint16
+
+			for _, ext := range captureClientHello(t, client).extensions {
+				if isGREASE(ext) {
+					grease = append(grease, ext)
+				}
+			}
+
+			if !slices.Equal(grease, testCase.expectedGREASE) {
+				t.Errorf("Unexpected GREASE extensions for %s, expected: %x got: %x", testCase.name, testCase.expectedGREASE, grease)
+			}
+		}
+	}
+}
+
+func TestGREASEOffSpec(t *testing.T) {
+	spec, err := helloShaping{grease: GREASEOff}.apply(nil, tls.HelloChrome_140, false)
+
+	if err != nil {
+		t.Fatalf("Unexpected error while shaping spec: %v", err)
+	}
+
+	for _, suite := range spec.CipherSuites {
+		if isGREASEValue(suite) {
+			t.Errorf("GREASE cipher suite left in spec: %x", suite)
+		}
+	}
+
+	for _, ext := range spec.Extensions {
+		switch ext := ext.(type) {
+		case *tls.UtlsGREASEExtension:
+			t.Errorf("GREASE extension left in spec")
+		case *tls.SupportedVersionsExtension:
+			if slices.ContainsFunc(ext.Versions, isGREASEValue) {
+				t.Errorf("GREASE version left in spec: %x", ext.Versions)
+			}
+		}
+	}
+}
+
+func TestPaddingModes(t *testing.T) {
+	hasPadding := func(spec *tls.ClientHelloSpec) bool {
+		return slices.ContainsFunc(spec.Extensions, func(ext tls.TLSExtension) bool {
+			_, ok := ext.(*tls.UtlsPaddingExtension)
+			return ok
+		})
+	}
+
+	testCases := []struct {
+		name            string
+		helloID         tls.ClientHelloID
+		padding         PaddingMode
+		expectedPadding bool
+	}{
+		{name: "boring on unpadded profile", helloID: tls.HelloChrome_140, padding: PaddingBoring, expectedPadding: true},
+		{name: "off on padded profile", helloID: tls.HelloChrome_100, padding: PaddingOff, expectedPadding: false},
+	}
+
+	for _, testCase := range testCases {
+		preset, err := tls.UTLSIdToSpec(testCase.helloID)
+
+		if err != nil {
+			t.Fatalf("Unexpected error for %s while loading spec: %v", testCase.name, err)
+		}
+
+		if hasPadding(&preset) == testCase.expectedPadding {
+			t.Fatalf("Profile for %s does not exercise the padding mode", testCase.name)
+		}
+
+		spec, err := helloShaping{padding: testCase.padding}.apply(&preset, testCase.helloID, false)
+
+		if err != nil {
+			t.Fatalf("Unexpected error for %s while shaping spec: %v", testCase.name, err)
+		}
+
+		if hasPadding(spec) != testCase.expectedPadding {
+			t.Errorf("Unexpected padding for %s, expected: %t", testCase.name, testCase.expectedPadding)
+		}
+
+		if _, ok := spec.Extensions[len(spec.Extensions)-1].(*tls.UtlsGREASEExtension); !ok {
+			t.Errorf("Trailing GREASE extension moved for %s", testCase.name)
+		}
+	}
+}
+
+func sortedExtensions(extensions []uint16) []uint16 {
+	sorted := withoutGREASE(extensions)
+	slices.Sort(sorted)
+
+	return sorted
+}
@@ -1,18 +1,25 @@
 package http_client
 
 import (
+	"context"
+	"crypto/x509"
 	"io"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	fhttp "github.com/vimbing/fhttp"
 	"github.com/vimbing/fhttp/cookiejar"
 	"github.com/vimbing/fhttp/http2"
 	tls "github.com/vimbing/utls"
+	"golang.org/x/net/proxy"
 )
 
 type OptionStringJa string
 type OptionTimeout time.Duration
+type OptionTimeouts Timeouts
 type OptionProxy string
+type OptionProxyList []OptionProxy
 type OptionDisallowRedirect bool
 type OptionForcedProxyRotation bool
 type OptionTLSHelloID tls.ClientHelloID
@@ -24,10 +31,75 @@ type OptionResponseMiddleware []ResponseMiddlewareFunc
 type OptionResponseErrorMiddleware []ResponseErrorMiddlewareFunc
 type OptionRetry *Retry
 type OptionStatusValidationFunc StatusValidationFunc
+type OptionResolver struct{ Resolver }
+type OptionLocalAddrPool *LocalAddrPool
+type OptionIPFamily IPFamily
+type OptionTLSSessionCache struct{ tls.ClientSessionCache }
+type OptionDisableTLSSessionResumption bool
+type OptionKeyLogWriter struct{ io.Writer }
+type OptionKeyLogFromEnv bool
+type OptionRootCAs *x509.CertPool
+type OptionECHFromDNS bool
+type OptionTLSSeed uint64
+type OptionHooks Hooks
+type OptionProtocol Protocol
+type OptionALPN []string
+type OptionH2C H2CMode
+type OptionDialer struct{ proxy.ContextDialer }
+type OptionPool PoolSettings
 
+// OptionJar, OptionRetryPolicy, OptionLocalAddrs and OptionRootCAPool wrap
+// the pointer types above, which can't be ClientOptions, for NewClient:
+//
+//	NewClient(OptionRetryPolicy{retry})
+type OptionJar struct{ *cookiejar.Jar }
+type OptionRetryPolicy struct{ *Retry }
+type OptionLocalAddrs struct{ *LocalAddrPool }
+type OptionRootCAPool struct{ *x509.CertPool }
+
+type OptionMethod string
+type OptionHeader fhttp.Header
+type OptionBody struct{ io.Reader }
+type OptionJSON struct{ value any }
+
+type OptionHostTlsProfile struct {
+	pattern string
+	regexp  bool
+	profile TlsProfile
+}
+
+type OptionECHConfigList struct {
+	host       string
+	configList []byte
+}
+
+type OptionCertificatePins struct {
+	host string
+	kind PinKind
+	pins []string
+}
+
+type OptionClientCertificate struct {
+	cert     tls.Certificate
+	certFile string
+	keyFile  string
+}
+
+// Client is safe for concurrent use. Reconfiguring it never affects
+// requests that are already in flight.
 type Client struct {
+	mu          sync.RWMutex
 	fhttpClient *fhttp.Client
 	cfg         *Config
+
+	// proxyStates holds the snapshots of cfg bound to the proxies requests
+	// picked with Request.SetProxy, up to maxProxyStates of them
+	proxyStates *lruCache[string, clientState]
+}
+
+type clientState struct {
+	cfg         *Config
+	fhttpClient *fhttp.Client
 }
 
 type RequestMiddlewareFunc func(*Request) error
@@ -37,13 +109,45 @@ type ResponseErrorMiddlewareFunc func(*Request, error)
 type TransportHttp2Settings struct {
 	Order    []http2.SettingID
 	Settings map[http2.SettingID]uint32
+
+	// Priorities are the PRIORITY frames sent right after the connection
+	// WINDOW_UPDATE, as Firefox did before version 120.
+	Priorities []Http2Priority
+
+	// HeaderPriority replaces the priority of HEADERS frames, nil keeps
+	// Chrome's exclusive dependency on stream 0 with weight 256.
+	// NoHeaderPriority sends HEADERS without one, as Safari does.
+	HeaderPriority   *http2.PriorityParam
+	NoHeaderPriority bool
+
+	// PseudoHeaderOrder orders :method, :authority, :scheme and :path.
+	// Missing ones follow in that order, a PHeaderOrderKey set on the
+	// request wins.
+	PseudoHeaderOrder []string
 }
 
+// Http2Priority is a PRIORITY frame for StreamID.
+type Http2Priority = http2.Priority
+
 type TransportSettings struct {
 	Spec          *tls.ClientHelloSpec
 	HelloID       tls.ClientHelloID
 	Http2Settings TransportHttp2Settings
-	Flow          uint32
+
+	// Flow is the increment of the WINDOW_UPDATE opening every HTTP/2
+	// connection, zero sends Chrome's 15663105. Values taking the window
+	// beyond 2^31-1 fail with ErrInvalidFlow.
+	Flow uint32
+
+	// DisableSessionResumption turns off TLS session resumption, which
+	// browsers do by default, for clients using this profile.
+	DisableSessionResumption bool
+
+	// ShuffleExtensions gives every connection a fresh permutation of the
+	// ClientHello extensions, as Chrome does since version 106.
+	ShuffleExtensions bool
+	GREASE            GREASEMode
+	Padding           PaddingMode
 }
 
 type Config struct {
@@ -54,17 +158,54 @@ type Config struct {
 	proxies                 []string
 	forceRotation           bool
 	allowRedirect           bool
-	timeout                 time.Duration
+	timeouts                Timeouts
+	resolver                Resolver
+	localAddrs              *LocalAddrPool
+	ipFamily                IPFamily
+	tlsSessionCache         tls.ClientSessionCache
+	disableTLSResumption    bool
+	rootCAs                 *x509.CertPool
+	certificatePins         []certificatePins
+	clientCertificates      []tls.Certificate
+	keyLogWriter            io.Writer
+	keyLogFromEnv           bool
+	echConfigs              []echConfigList
+	echFromDNS              bool
+	tlsRand                 io.Reader
+	optionErrors            []error
 	jar                     *cookiejar.Jar
 	transportSettings       TransportSettings
+	hostProfiles            []hostProfile
+	protocol                Protocol
+	alpn                    []string
+	h2c                     H2CMode
+	dialer                  proxy.ContextDialer
+	pool                    PoolSettings
+	hooks                   Hooks
 	retry                   *Retry
 	statusValidationFunc    StatusValidationFunc
 }
 
+// Deprecated: a RequestJsonBody is indistinguishable from the value it
+// wraps and is rejected like any other unknown option, use WithJSON.
 type RequestJsonBody any
 type QueryParams map[string]string
 type FormUrlEncoded map[string]string
 
+// Param is a key and value of an OrderedQueryParams or OrderedFormUrlEncoded.
+type Param struct {
+	Key   string
+	Value string
+}
+
+// OrderedQueryParams are query parameters encoded in their order, keys may
+// repeat.
+type OrderedQueryParams []Param
+
+// OrderedFormUrlEncoded is a url-encoded body with the fields in their order,
+// keys may repeat.
+type OrderedFormUrlEncoded []Param
+
 type Request struct {
 	Method string
 	Body   io.Reader
@@ -78,13 +219,29 @@ type Request struct {
 	protoMajor int
 	proto      string
 
+	timeouts   Timeouts
+	tlsProfile *requestProfile
+	protocol   Protocol
+
 	host         *string
+	proxy        *string
 	fhttpRequest *fhttp.Request
 }
 
 type Response struct {
 	Body          []byte
 	fhttpResponse *fhttp.Response
+	connInfo      ConnInfo
+	timings       Timings
+}
+
+type requestExecution struct {
+	phase    atomic.Value
+	timeouts Timeouts
+	hooks    Hooks
+	clock    *phaseClock
+	cancel   context.CancelCauseFunc
+	connInfo atomic.Pointer[ConnInfo]
 }
 
 type requestExecutionResult struct {
@@ -92,6 +249,51 @@ type requestExecutionResult struct {
 	error error
 }
 
+// RequestPhase names the stage of a request that was in progress when it
+// failed, see TimeoutError.
+type RequestPhase string
+
+const (
+	PhaseDNS             RequestPhase = "dns lookup"
+	PhaseDial            RequestPhase = "tcp dial"
+	PhaseProxyConnect    RequestPhase = "proxy connect"
+	PhaseTLSHandshake    RequestPhase = "tls handshake"
+	PhaseResponseHeaders RequestPhase = "awaiting response headers"
+	PhaseBodyRead        RequestPhase = "body read"
+	PhaseMiddleware      RequestPhase = "response middleware"
+)
+
+// Timeouts splits a request into separately bounded phases. Zero fields are
+// not enforced, every phase is still bounded by Total.
+type Timeouts struct {
+	Total        time.Duration
+	DNS          time.Duration
+	Dial         time.Duration
+	ProxyConnect time.Duration
+	TLSHandshake time.Duration
+	FirstByte    time.Duration
+	BodyRead     time.Duration
+}
+
+// PoolSettings controls the connections kept to every host. Zero fields
+// keep the defaults, which pool without limits.
+type PoolSettings struct {
+	// MaxConnsPerHost caps the connections open to one host, requests
+	// beyond it wait for a free connection or stream.
+	MaxConnsPerHost int
+	// MaxIdleConnsPerHost caps the idle HTTP/1.1 connections kept to one
+	// host, fhttp keeps 2 by default.
+	MaxIdleConnsPerHost int
+	// MaxConcurrentStreams caps the requests carried by one HTTP/2
+	// connection below the server's limit, a new connection is opened
+	// once all of them are busy.
+	MaxConcurrentStreams int
+	// IdleConnTimeout closes connections that stayed idle for longer.
+	IdleConnTimeout time.Duration
+	// DisableKeepAlives uses every connection for a single request.
+	DisableKeepAlives bool
+}
+
 type Retry struct {
 	Max           int
 	Delay         time.Duration
@@ -106,4 +308,9 @@ type StatusValidationFunc func(status int, client *Client) error
 
 type TlsProfile struct {
 	TransportSettings
+
+	// ID names the profile for Request.SetTlsProfile, requests whose
+	// profiles share an ID share transports and connections. Without one
+	// only a request and its redirects do.
+	ID string
 }
@@ -0,0 +1,136 @@
+package http_client
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+const (
+	unixSocketScheme = "unix://"
+
+	// unixSocketHostSuffix marks hosts that name a Unix socket, the labels
+	// before it are the hex encoded socket path.
+	unixSocketHostSuffix = ".unix-socket"
+
+	// unixSocketHost is sent as Host header to sockets unless the request
+	// sets one.
+	unixSocketHost = "localhost"
+)
+
+// unixSocketURL rewrites a URL of the form unix:///path/to.sock:/request
+// into an http:// one whose host names the socket, so connections to
+// different sockets are never pooled together. ok is false for other URLs.
+func unixSocketURL(rawURL string) (rewritten string, ok bool) {
+	if len(rawURL) < len(unixSocketScheme) || !strings.EqualFold(rawURL[:len(unixSocketScheme)], unixSocketScheme) {
+		return rawURL, false
+	}
+
+	socketPath, target, _ := strings.Cut(rawURL[len(unixSocketScheme):], ":")
+
+	if !strings.HasPrefix(target, "/") {
+		target = "/" + target
+	}
+
+	encoded := hex.EncodeToString([]byte(socketPath))
+
+	// keep every label within the 63 bytes DNS allows
+	var labels []string
+
+	for len(encoded) > 62 {
+		labels = append(labels, encoded[:62])
+		encoded = encoded[62:]
+	}
+
+	labels = append(labels, encoded)
+
+	return "http://" + strings.Join(labels, ".") + unixSocketHostSuffix + target, true
+}
+
+// unixSocketPath returns the socket a host produced by unixSocketURL names.
+func unixSocketPath(addr string) (string, bool) {
+	host, _, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		host = addr
+	}
+
+	encoded, ok := strings.CutSuffix(host, unixSocketHostSuffix)
+
+	if !ok {
+		return "", false
+	}
+
+	socketPath, err := hex.DecodeString(strings.ReplaceAll(encoded, ".", ""))
+
+	if err != nil {
+		return "", false
+	}
+
+	return string(socketPath), true
+}
+
+// unixSocketDialer dials the socket for hosts naming one and hands every
+// other address to dialer.
+type unixSocketDialer struct {
+	dialer   proxy.ContextDialer
+	timeouts Timeouts
+}
+
+func (d *unixSocketDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *unixSocketDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	socketPath, ok := unixSocketPath(addr)
+
+	if !ok {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+
+	dialCtx, cancel := phaseContext(ctx, PhaseDial, contextTimeouts(ctx, d.timeouts).Dial)
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(dialCtx, "unix", socketPath)
+	err = phaseErr(dialCtx, err)
+
+	connectDone(ctx, ConnectDoneInfo{Network: "unix", Addr: socketPath, Err: err})
+
+	return conn, err
+}
+
+// customDialer bounds a dialer set through WithDialer by the dial timeout
+// and reports it to the hooks.
+type customDialer struct {
+	dialer   proxy.ContextDialer
+	timeouts Timeouts
+}
+
+func (d *customDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *customDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialCtx, cancel := phaseContext(ctx, PhaseDial, contextTimeouts(ctx, d.timeouts).Dial)
+	defer cancel()
+
+	conn, err := d.dialer.DialContext(dialCtx, network, addr)
+	err = phaseErr(dialCtx, err)
+
+	connectDone(ctx, ConnectDoneInfo{Network: network, Addr: addr, Err: err})
+
+	return conn, err
+}
+
+// baseDialer returns the dialer connections, or the ones to the proxy, are
+// made with.
+func (cfg *Config) baseDialer() proxy.ContextDialer {
+	if cfg.dialer != nil {
+		return &customDialer{dialer: cfg.dialer, timeouts: cfg.timeouts}
+	}
+
+	return newDirectDialer(cfg)
+}
@@ -0,0 +1,129 @@
+package http_client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// startUnixSocketServer serves the name, request target and Host header of
+// every request on a Unix socket and returns the socket path.
+func startUnixSocketServer(t *testing.T, name string) string {
+	socketPath := filepath.Join(t.TempDir(), name+".sock")
+	listener, err := net.Listen("unix", socketPath)
+
+	if err != nil {
+		t.Fatalf("Unexpected error while listening: %v", err)
+	}
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.RequestURI + " " + r.Host))
+		}),
+	}
+
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	return socketPath
+}
+
+func TestUnixSocket(t *testing.T) {
+	first := startUnixSocketServer(t, "first")
+	second := startUnixSocketServer(t, "second")
+
+	client := MustNew()
+
+	testCases := []struct {
+		url      string
+		host     string
+		expected string
+	}{
+		{url: "unix://" + first + ":/v1/info?all=1", expected: "first /v1/info?all=1 localhost"},
+		{url: "unix://" + second + ":/v1/info", expected: "second /v1/info localhost"},
+		{url: "unix://" + first + ":/", host: "docker", expected: "first / docker"},
+	}
+
+	for _, testCase := range testCases {
+		req, err := client.NewRequest(testCase.url, "GET", nil, nil)
+
+		if err != nil {
+			t.Fatalf("Unexpected error while building request: %v", err)
+		}
+
+		if len(testCase.host) > 0 {
+			req.SetHost(testCase.host)
+		}
+
+		res, err := client.Do(req)
+
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", testCase.url, err)
+		}
+
+		if res.BodyString() != testCase.expected {
+			t.Errorf("Unexpected response for %s, expected: %s got: %s", testCase.url, testCase.expected, res.BodyString())
+		}
+	}
+}
+
+func TestUnixSocketURL(t *testing.T) {
+	socketPath := "/var/run/" + strings.Repeat("long-directory/", 8) + "docker.sock"
+
+	rewritten, ok := unixSocketURL("unix://" + socketPath + ":/containers/json")
+
+	if !ok || !strings.HasPrefix(rewritten, "http://") || !strings.HasSuffix(rewritten, unixSocketHostSuffix+"/containers/json") {
+		t.Fatalf("Unexpected URL: %s", rewritten)
+	}
+
+	host := strings.TrimSuffix(strings.TrimPrefix(rewritten, "http://"), "/containers/json")
+
+	for _, label := range strings.Split(host, ".") {
+		if len(label) > 63 {
+			t.Errorf("Label is too long: %s", label)
+		}
+	}
+
+	if decoded, ok := unixSocketPath(host + ":80"); !ok || decoded != socketPath {
+		t.Errorf("Unexpected socket path: %s", decoded)
+	}
+
+	if _, ok := unixSocketURL("https://example.com/"); ok {
+		t.Errorf("Non socket URL was rewritten")
+	}
+}
+
+type countingDialer struct {
+	dials atomic.Int64
+}
+
+func (d *countingDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.dials.Add(1)
+	return (&net.Dialer{}).DialContext(ctx, network, addr)
+}
+
+func TestWithDialer(t *testing.T) {
+	dialer := &countingDialer{}
+
+	hello := captureClientHello(t, MustNew(WithDialer(dialer), WithTlsProfile(chrome140Profile())))
+
+	if dialer.dials.Load() != 1 {
+		t.Errorf("Unexpected number of dials: %d", dialer.dials.Load())
+	}
+
+	// the fingerprint is applied on top of the custom dialer
+	expected := captureClientHello(t, MustNew(WithTlsProfile(chrome140Profile())))
+
+	if !slices.Equal(sortedExtensions(withoutGREASE(hello.extensions)), sortedExtensions(withoutGREASE(expected.extensions))) {
+		t.Errorf("Unexpected extensions, expected: %v got: %v", expected.extensions, hello.extensions)
+	}
+}